@@ -1,6 +1,13 @@
 package zigbee
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
 
 // Address is a generic interface for a zigbee address.
 type Address interface {
@@ -8,25 +15,132 @@ type Address interface {
 	IsGroup() bool
 }
 
+const (
+	// ZDOEndpoint is the endpoint reserved to the ZigBee Device Object.
+	ZDOEndpoint uint32 = 0
+	// MinApplicationEndpoint is the lowest endpoint available to applications.
+	MinApplicationEndpoint uint32 = 1
+	// MaxApplicationEndpoint is the highest endpoint available to applications.
+	MaxApplicationEndpoint uint32 = 240
+)
+
+const (
+	// BroadcastAllDevices is the network address of the broadcast to all devices.
+	BroadcastAllDevices uint32 = 0xFFFF
+	// BroadcastRxOnWhenIdle is the network address of the broadcast to devices with receiver on when idle.
+	BroadcastRxOnWhenIdle uint32 = 0xFFFD
+	// BroadcastRouters is the network address of the broadcast to routers and coordinator.
+	BroadcastRouters uint32 = 0xFFFC
+	// minBroadcastAddress is the lowest network address of the range reserved to broadcasts.
+	minBroadcastAddress uint32 = 0xFFF8
+)
+
 // DeviceAddress defines a unicast ZigBee address.
 type DeviceAddress struct {
 	NetworkAddress uint32 `json:"networkAddress"`
 	Endpoint       uint32 `json:"endpoint"`
 }
 
+// NewDeviceAddress will create a new device address.
+func NewDeviceAddress(networkAddress, endpoint uint32) DeviceAddress {
+	return DeviceAddress{NetworkAddress: networkAddress, Endpoint: endpoint}
+}
+
+// NewZDOAddress will create the address of the ZigBee Device Object of the supplied network address.
+func NewZDOAddress(networkAddress uint32) DeviceAddress {
+	return NewDeviceAddress(networkAddress, ZDOEndpoint)
+}
+
 // IsGroup will identify this address as not be a group address.
 func (a DeviceAddress) IsGroup() bool {
 	return false
 }
 
+// IsBroadcast will check if the network address is in the range reserved to broadcasts, so that the address never
+// identifies a single device.
+func (a DeviceAddress) IsBroadcast() bool {
+	return a.NetworkAddress >= minBroadcastAddress && a.NetworkAddress <= BroadcastAllDevices
+}
+
+// Less will check if the address is ordered before the other one. Addresses are ordered by network address and then
+// by endpoint.
+func (a DeviceAddress) Less(other DeviceAddress) bool {
+	if a.NetworkAddress != other.NetworkAddress {
+		return a.NetworkAddress < other.NetworkAddress
+	}
+	return a.Endpoint < other.Endpoint
+}
+
+// SortDeviceAddresses will sort the supplied addresses in ascending order.
+func SortDeviceAddresses(addresses []DeviceAddress) {
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i].Less(addresses[j])
+	})
+}
+
 func (a DeviceAddress) String() string {
 	return fmt.Sprintf("%d/%d", a.NetworkAddress, a.Endpoint)
 }
 
+// HexString returns the address with the network address in hex, as logged by coordinators, for example "0x1a2b/1".
+// ParseDeviceAddress accepts both String and HexString forms.
+func (a DeviceAddress) HexString() string {
+	return fmt.Sprintf("0x%04x/%d", a.NetworkAddress, a.Endpoint)
+}
+
+// ParseDeviceAddress will parse a device address in the "network/endpoint" form, with the network address either
+// decimal or 0x-prefixed hex.
+func ParseDeviceAddress(s string) (DeviceAddress, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return DeviceAddress{}, newCodedError(CodeInvalid, fmt.Sprintf("Invalid device address %q", s))
+	}
+	network := parts[0]
+	base := 10
+	if strings.HasPrefix(network, "0x") || strings.HasPrefix(network, "0X") {
+		network, base = network[2:], 16
+	}
+	networkAddress, err := strconv.ParseUint(network, base, 32)
+	if err != nil {
+		return DeviceAddress{}, newCodedErrorWithCause(CodeInvalid, fmt.Sprintf("Invalid device address network address %q", s), err)
+	}
+	endpoint, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return DeviceAddress{}, newCodedErrorWithCause(CodeInvalid, fmt.Sprintf("Invalid device address endpoint %q", s), err)
+	}
+	return NewDeviceAddress(uint32(networkAddress), uint32(endpoint)), nil
+}
+
+// AnyEndpoint is the DeviceAddressPattern endpoint matching any endpoint.
+const AnyEndpoint uint32 = 0xFFFFFFFF
+
+// DeviceAddressPattern defines a pattern matching device addresses.
+type DeviceAddressPattern struct {
+	NetworkAddress uint32
+	Endpoint       uint32
+}
+
+// Matches will check if the supplied address matches this pattern.
+func (p DeviceAddressPattern) Matches(address DeviceAddress) bool {
+	if p.NetworkAddress != address.NetworkAddress {
+		return false
+	}
+	return p.Endpoint == AnyEndpoint || p.Endpoint == address.Endpoint
+}
+
+const (
+	// MinGroupID is the lowest usable group id. Group id 0x0000 is reserved.
+	MinGroupID uint32 = 0x0001
+	// MaxGroupID is the highest usable group id. Group ids from 0xFFF8 to 0xFFFF are reserved.
+	MaxGroupID uint32 = 0xFFF7
+)
+
 // GroupAddress defines a group ZigBee address.
 type GroupAddress struct {
 	GroupID uint32 `json:"groupId"`
 	Label   string `json:"label"`
+	// Scope identifies the coordinator owning the group in multi coordinator deployments. Default scope is 0.
+	Scope uint32 `json:"scope,omitempty"`
 }
 
 // IsGroup will identify this address as to be a group address.
@@ -34,6 +148,104 @@ func (a GroupAddress) IsGroup() bool {
 	return true
 }
 
+// groupKey is the key identifying a group address within a network.
+type groupKey struct {
+	scope   uint32
+	groupID uint32
+}
+
+func (a GroupAddress) key() groupKey {
+	return groupKey{scope: a.Scope, groupID: a.GroupID}
+}
+
+// Validate will check that the group id is in the usable 16-bit range.
+func (a GroupAddress) Validate() error {
+	if a.GroupID < MinGroupID || a.GroupID > MaxGroupID {
+		return newCodedError(CodeInvalid, fmt.Sprintf("Group id 0x%04x is outside the valid range 0x%04x-0x%04x", a.GroupID, MinGroupID, MaxGroupID))
+	}
+	return nil
+}
+
+// ID returns the decimal group id.
+func (a GroupAddress) ID() string {
+	return strconv.FormatUint(uint64(a.GroupID), 10)
+}
+
+// HexID returns the hexadecimal group id, prefixed by 0x and padded to 4 digits.
+func (a GroupAddress) HexID() string {
+	return fmt.Sprintf("0x%04x", a.GroupID)
+}
+
 func (a GroupAddress) String() string {
 	return fmt.Sprintf("%d/%s", a.GroupID, a.Label)
 }
+
+// MarshalJSON will implement JSON serialization as an object, since MarshalText is meant for text keys only.
+func (a GroupAddress) MarshalJSON() ([]byte, error) {
+	// serializedGroupAddress has no methods, so it's serialized with the default encoding
+	type serializedGroupAddress GroupAddress
+	return json.Marshal(serializedGroupAddress(a))
+}
+
+// UnmarshalJSON will implement JSON deserialization from an object, since UnmarshalText is meant for text keys only.
+func (a *GroupAddress) UnmarshalJSON(data []byte) error {
+	type serializedGroupAddress GroupAddress
+	return json.Unmarshal(data, (*serializedGroupAddress)(a))
+}
+
+// MarshalText will encode the group address as text, in the form groupId/label or scope:groupId/label when the
+// scope is not the default one. The label is escaped, so it can contain any character.
+func (a GroupAddress) MarshalText() ([]byte, error) {
+	text := fmt.Sprintf("%d/%s", a.GroupID, url.PathEscape(a.Label))
+	if a.Scope != 0 {
+		text = fmt.Sprintf("%d:%s", a.Scope, text)
+	}
+	return []byte(text), nil
+}
+
+// UnmarshalText will decode a group address encoded by MarshalText.
+func (a *GroupAddress) UnmarshalText(text []byte) error {
+	parts := strings.SplitN(string(text), "/", 2)
+	if len(parts) != 2 {
+		return newCodedError(CodeInvalid, fmt.Sprintf("Invalid group address %q", text))
+	}
+	var scope uint64
+	id := parts[0]
+	if i := strings.Index(id, ":"); i >= 0 {
+		var err error
+		if scope, err = strconv.ParseUint(id[:i], 10, 32); err != nil {
+			return newCodedErrorWithCause(CodeInvalid, fmt.Sprintf("Invalid group address scope %q", text), err)
+		}
+		id = id[i+1:]
+	}
+	groupID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return newCodedErrorWithCause(CodeInvalid, fmt.Sprintf("Invalid group address id %q", text), err)
+	}
+	label, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return newCodedErrorWithCause(CodeInvalid, fmt.Sprintf("Invalid group address label %q", text), err)
+	}
+	*a = GroupAddress{GroupID: uint32(groupID), Label: label, Scope: uint32(scope)}
+	return nil
+}
+
+// IsGroupAddressString will check if the supplied string, in the form produced by String, is a group address. Group
+// addresses are recognized by a non numeric second segment, so a group whose label is a number is reported as a
+// device address.
+func IsGroupAddressString(s string) bool {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return false
+	}
+	label := s[i+1:]
+	if label == "" {
+		return true
+	}
+	for _, r := range label {
+		if r < '0' || r > '9' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package zigbee
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestGroupAddressValidate(t *testing.T) {
+	for _, test := range []struct {
+		groupID uint32
+		valid   bool
+	}{
+		{0, false},
+		{1, true},
+		{0xFFF7, true},
+		{0xFFFF, false},
+		{0x10000, false},
+	} {
+		err := GroupAddress{GroupID: test.groupID}.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("Group id 0x%04x: expected valid %t, got error %v", test.groupID, test.valid, err)
+		}
+		if err != nil && CodeOf(err) != CodeInvalid {
+			t.Errorf("Group id 0x%04x: expected invalid code, got %v", test.groupID, err)
+		}
+	}
+}
+
+func TestAddGroupChecked(t *testing.T) {
+	n := NewNetworkState(true)
+	if err := n.AddGroupChecked(GroupAddress{GroupID: 0x10000, Label: "kitchen"}); err == nil {
+		t.Fatal("Expected out of range group to be rejected")
+	}
+	if err := n.AddGroupChecked(GroupAddress{GroupID: 0xFFF7, Label: "kitchen"}); err != nil {
+		t.Fatal(err)
+	}
+	if groups := n.Groups(); len(groups) != 1 || groups[0].GroupID != 0xFFF7 {
+		t.Fatalf("Expected only the valid group to be added, got %v", groups)
+	}
+}
+
+func TestDeviceAddressPatternMatches(t *testing.T) {
+	for _, test := range []struct {
+		pattern DeviceAddressPattern
+		address DeviceAddress
+		matches bool
+	}{
+		{DeviceAddressPattern{NetworkAddress: 1, Endpoint: 2}, NewDeviceAddress(1, 2), true},
+		{DeviceAddressPattern{NetworkAddress: 1, Endpoint: AnyEndpoint}, NewDeviceAddress(1, 0), true},
+		{DeviceAddressPattern{NetworkAddress: 1, Endpoint: AnyEndpoint}, NewDeviceAddress(1, 240), true},
+		{DeviceAddressPattern{NetworkAddress: 1, Endpoint: 2}, NewDeviceAddress(1, 3), false},
+		{DeviceAddressPattern{NetworkAddress: 1, Endpoint: AnyEndpoint}, NewDeviceAddress(2, 1), false},
+	} {
+		if matches := test.pattern.Matches(test.address); matches != test.matches {
+			t.Errorf("Pattern %v and address %s: expected match %t", test.pattern, test.address, test.matches)
+		}
+	}
+}
+
+func TestDevicesMatching(t *testing.T) {
+	n := NewNetworkState(true)
+	for endpoint := uint32(1); endpoint <= 2; endpoint++ {
+		device := testDevice(1, 1)
+		device.NetworkAddress = NewDeviceAddress(1, endpoint)
+		n.AddDevice(device)
+	}
+	n.AddDevice(testDevice(2, 2))
+	if devices := n.DevicesMatching(DeviceAddressPattern{NetworkAddress: 1, Endpoint: AnyEndpoint}); len(devices) != 2 {
+		t.Fatalf("Expected both endpoints to match, got %v", devices)
+	}
+	if devices := n.DevicesMatching(DeviceAddressPattern{NetworkAddress: 1, Endpoint: 2}); len(devices) != 1 {
+		t.Fatalf("Expected a single exact match, got %v", devices)
+	}
+	if devices := n.DevicesMatching(DeviceAddressPattern{NetworkAddress: 3, Endpoint: AnyEndpoint}); len(devices) != 0 {
+		t.Fatalf("Expected no match, got %v", devices)
+	}
+}
+
+func TestGroupAddressTextRoundTrip(t *testing.T) {
+	for _, group := range []GroupAddress{
+		{GroupID: 1, Label: "kitchen"},
+		{GroupID: 2, Label: "living room"},
+		{GroupID: 3, Label: "a/b: c, d? 100%"},
+		{GroupID: 4, Label: ""},
+		{GroupID: 5, Label: "garden", Scope: 7},
+	} {
+		text, err := group.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded GroupAddress
+		if err := decoded.UnmarshalText(text); err != nil {
+			t.Fatalf("Unable to decode %q: %v", text, err)
+		}
+		if decoded != group {
+			t.Errorf("Expected %q to decode as %v, got %v", text, group, decoded)
+		}
+	}
+	var decoded GroupAddress
+	for _, text := range []string{"kitchen", "x/kitchen", "x:1/kitchen", "1/%zz"} {
+		if err := decoded.UnmarshalText([]byte(text)); CodeOf(err) != CodeInvalid {
+			t.Errorf("Expected %q to be rejected, got %v", text, err)
+		}
+	}
+}
+
+func TestGroupAddressMapKeys(t *testing.T) {
+	labels := map[GroupAddress]int{{GroupID: 1, Label: "living room"}: 1, {GroupID: 2, Label: "a/b", Scope: 3}: 2}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[GroupAddress]int
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, labels) {
+		t.Fatalf("Expected group address keys to round trip, got %v from %s", decoded, data)
+	}
+}
+
+func TestDeviceAddressLess(t *testing.T) {
+	addresses := []DeviceAddress{
+		NewDeviceAddress(1, 0), NewDeviceAddress(1, 1), NewDeviceAddress(1, 2),
+		NewDeviceAddress(2, 0), NewDeviceAddress(0xFFFF, 240),
+	}
+	for i, a := range addresses {
+		if a.Less(a) {
+			t.Errorf("Expected %s not to be less than itself", a)
+		}
+		for j, b := range addresses {
+			if a.Less(b) != (i < j) {
+				t.Errorf("Expected %s less than %s to be %t", a, b, i < j)
+			}
+			if a.Less(b) && b.Less(a) {
+				t.Errorf("Expected %s and %s not to be both less than each other", a, b)
+			}
+		}
+	}
+	shuffled := []DeviceAddress{addresses[3], addresses[1], addresses[4], addresses[0], addresses[2]}
+	SortDeviceAddresses(shuffled)
+	if !reflect.DeepEqual(shuffled, addresses) {
+		t.Fatalf("Expected addresses sorted with ties broken by endpoint, got %v", shuffled)
+	}
+}
+
+func TestIsGroupAddressString(t *testing.T) {
+	for _, test := range []struct {
+		s     string
+		group bool
+	}{
+		{NewDeviceAddress(1, 1).String(), false},
+		{NewDeviceAddress(0xFFFF, 240).String(), false},
+		{GroupAddress{GroupID: 1, Label: "kitchen"}.String(), true},
+		{GroupAddress{GroupID: 1}.String(), true},
+		{GroupAddress{GroupID: 1, Label: "room 2"}.String(), true},
+		{GroupAddress{GroupID: 1, Label: "42"}.String(), false},
+		{"1", false},
+		{"", false},
+	} {
+		if group := IsGroupAddressString(test.s); group != test.group {
+			t.Errorf("Expected %q group address to be %t, got %t", test.s, test.group, group)
+		}
+	}
+}
+
+func TestGroupAddressIDs(t *testing.T) {
+	for _, test := range []struct {
+		groupID uint32
+		id      string
+		hexID   string
+	}{
+		{0, "0", "0x0000"},
+		{1, "1", "0x0001"},
+		{255, "255", "0x00ff"},
+		{0x1234, "4660", "0x1234"},
+		{0xFFF7, "65527", "0xfff7"},
+		{0x10000, "65536", "0x10000"},
+	} {
+		address := GroupAddress{GroupID: test.groupID, Label: "kitchen"}
+		if address.ID() != test.id || address.HexID() != test.hexID {
+			t.Errorf("Expected group %d ids %s and %s, got %s and %s", test.groupID, test.id, test.hexID, address.ID(), address.HexID())
+		}
+	}
+}
+
+func TestNewZDOAddress(t *testing.T) {
+	address := NewZDOAddress(0x1234)
+	if address != NewDeviceAddress(0x1234, 0) || address.Endpoint != ZDOEndpoint {
+		t.Fatalf("Expected the ZDO endpoint of the node, got %v", address)
+	}
+	if s := address.String(); s != "4660/0" {
+		t.Fatalf("Expected ZDO address to render as 4660/0, got %s", s)
+	}
+}
+
+func TestBroadcastAddresses(t *testing.T) {
+	for _, test := range []struct {
+		address   uint32
+		broadcast bool
+	}{
+		{0x0000, false},
+		{0x1234, false},
+		{0xFFF7, false},
+		{0xFFF8, true},
+		{BroadcastRouters, true},
+		{BroadcastRxOnWhenIdle, true},
+		{BroadcastAllDevices, true},
+	} {
+		if broadcast := NewDeviceAddress(test.address, 1).IsBroadcast(); broadcast != test.broadcast {
+			t.Errorf("Expected address %x broadcast to be %t, got %t", test.address, test.broadcast, broadcast)
+		}
+	}
+	n := NewNetworkState(true)
+	n.AddDevice(testDevice(1, BroadcastAllDevices))
+	broadcast := NewDeviceAddress(BroadcastAllDevices, 1)
+	if _, ok := n.Device(broadcast); ok || n.DeviceExists(broadcast) {
+		t.Fatal("Expected broadcast addresses not to match stored devices")
+	}
+}
+
+func TestParseDeviceAddress(t *testing.T) {
+	for _, s := range []string{"6699/1", "0x1a2b/1", "0X1A2B/1"} {
+		address, err := ParseDeviceAddress(s)
+		if err != nil || address != NewDeviceAddress(0x1a2b, 1) {
+			t.Errorf("Expected %q to be parsed as 6699/1, got %v and %v", s, address, err)
+		}
+	}
+	for _, s := range []string{"", "6699", "0x/1", "0xzz/1", "abc/1", "6699/", "6699/x", "-1/1", "4294967296/1"} {
+		if _, err := ParseDeviceAddress(s); CodeOf(err) != CodeInvalid {
+			t.Errorf("Expected %q to be rejected, got %v", s, err)
+		}
+	}
+	address := NewDeviceAddress(0x1a2b, 240)
+	if address.HexString() != "0x1a2b/240" {
+		t.Fatalf("Expected hex string 0x1a2b/240, got %s", address.HexString())
+	}
+	for _, s := range []string{address.String(), address.HexString()} {
+		if parsed, err := ParseDeviceAddress(s); err != nil || parsed != address {
+			t.Errorf("Expected %q to round trip, got %v and %v", s, parsed, err)
+		}
+	}
+}
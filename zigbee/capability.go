@@ -0,0 +1,117 @@
+package zigbee
+
+// Well known ZCL cluster ids.
+const (
+	PowerConfigurationCluster     uint32 = 0x0001
+	OnOffCluster                  uint32 = 0x0006
+	LevelControlCluster           uint32 = 0x0008
+	DoorLockCluster               uint32 = 0x0101
+	WindowCoveringCluster         uint32 = 0x0102
+	ThermostatCluster             uint32 = 0x0201
+	ColorControlCluster           uint32 = 0x0300
+	IlluminanceMeasurementCluster uint32 = 0x0400
+	TemperatureMeasurementCluster uint32 = 0x0402
+	RelativeHumidityCluster       uint32 = 0x0405
+	OccupancySensingCluster       uint32 = 0x0406
+	IASZoneCluster                uint32 = 0x0500
+	MeteringCluster               uint32 = 0x0702
+)
+
+// DeviceCapabilities describes the features of a device, derived from its clusters.
+type DeviceCapabilities struct {
+	Light              bool
+	Dimmable           bool
+	Color              bool
+	Switch             bool
+	Lock               bool
+	WindowCovering     bool
+	Thermostat         bool
+	ReportsTemperature bool
+	ReportsHumidity    bool
+	ReportsIlluminance bool
+	ReportsOccupancy   bool
+	SecuritySensor     bool
+	Metering           bool
+	Battery            bool
+}
+
+// capabilityRule maps the presence of a cluster to a capability. Server clusters are the device input clusters,
+// while client clusters are the device output clusters, used to control other devices.
+type capabilityRule struct {
+	name    string
+	cluster uint32
+	server  bool
+	flag    func(*DeviceCapabilities) *bool
+}
+
+// capabilityRules is the table mapping clusters to capabilities.
+var capabilityRules = []capabilityRule{
+	{"light", OnOffCluster, true, func(c *DeviceCapabilities) *bool { return &c.Light }},
+	{"dimmable", LevelControlCluster, true, func(c *DeviceCapabilities) *bool { return &c.Dimmable }},
+	{"color", ColorControlCluster, true, func(c *DeviceCapabilities) *bool { return &c.Color }},
+	{"switch", OnOffCluster, false, func(c *DeviceCapabilities) *bool { return &c.Switch }},
+	{"lock", DoorLockCluster, true, func(c *DeviceCapabilities) *bool { return &c.Lock }},
+	{"windowCovering", WindowCoveringCluster, true, func(c *DeviceCapabilities) *bool { return &c.WindowCovering }},
+	{"thermostat", ThermostatCluster, true, func(c *DeviceCapabilities) *bool { return &c.Thermostat }},
+	{"temperature", TemperatureMeasurementCluster, true, func(c *DeviceCapabilities) *bool { return &c.ReportsTemperature }},
+	{"humidity", RelativeHumidityCluster, true, func(c *DeviceCapabilities) *bool { return &c.ReportsHumidity }},
+	{"illuminance", IlluminanceMeasurementCluster, true, func(c *DeviceCapabilities) *bool { return &c.ReportsIlluminance }},
+	{"occupancy", OccupancySensingCluster, true, func(c *DeviceCapabilities) *bool { return &c.ReportsOccupancy }},
+	{"security", IASZoneCluster, true, func(c *DeviceCapabilities) *bool { return &c.SecuritySensor }},
+	{"metering", MeteringCluster, true, func(c *DeviceCapabilities) *bool { return &c.Metering }},
+	{"battery", PowerConfigurationCluster, true, func(c *DeviceCapabilities) *bool { return &c.Battery }},
+}
+
+// Capabilities returns the capabilities of the device, derived from its input and output clusters.
+func (d Device) Capabilities() DeviceCapabilities {
+	var capabilities DeviceCapabilities
+	for _, rule := range capabilityRules {
+		if rule.matches(d) {
+			*rule.flag(&capabilities) = true
+		}
+	}
+	return capabilities
+}
+
+// Names returns the names of the capabilities, in the order of the capabilities table.
+func (c DeviceCapabilities) Names() []string {
+	names := []string{}
+	for _, rule := range capabilityRules {
+		if *rule.flag(&c) {
+			names = append(names, rule.name)
+		}
+	}
+	return names
+}
+
+// matches will check if the device has the capability described by the rule.
+func (r capabilityRule) matches(d Device) bool {
+	if r.server {
+		return containsCluster(d.InputClusterIds, r.cluster)
+	}
+	return containsCluster(d.OutputClusterIds, r.cluster)
+}
+
+// CapabilitySummary returns the number of devices having each capability, keyed by capability name (e.g. "light",
+// "switch", "temperature"). A device with more than one capability is counted once for each of them, so the counts
+// may add up to more than the number of devices. Capabilities no device has are omitted.
+func (n *Network) CapabilitySummary() map[string]int {
+	summary := make(map[string]int)
+	for _, device := range n.devicesSnapshot() {
+		for _, rule := range capabilityRules {
+			if rule.matches(device) {
+				summary[rule.name]++
+			}
+		}
+	}
+	return summary
+}
+
+func containsCluster(clusters []uint32, cluster uint32) bool {
+	for _, id := range clusters {
+		if id == cluster {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package zigbee
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeviceCapabilities(t *testing.T) {
+	for _, test := range []struct {
+		input  []uint32
+		output []uint32
+		names  []string
+	}{
+		{[]uint32{OnOffCluster}, nil, []string{"light"}},
+		{[]uint32{OnOffCluster, LevelControlCluster}, nil, []string{"light", "dimmable"}},
+		{nil, []uint32{OnOffCluster, LevelControlCluster}, []string{"switch"}},
+		{[]uint32{TemperatureMeasurementCluster, PowerConfigurationCluster}, nil, []string{"temperature", "battery"}},
+		{[]uint32{0xFC00}, nil, []string{}},
+	} {
+		device := Device{InputClusterIds: test.input, OutputClusterIds: test.output}
+		if names := device.Capabilities().Names(); !reflect.DeepEqual(names, test.names) {
+			t.Errorf("Expected clusters %v/%v to have capabilities %v, got %v", test.input, test.output, test.names, names)
+		}
+	}
+	capabilities := Device{InputClusterIds: []uint32{OnOffCluster, LevelControlCluster}}.Capabilities()
+	if !capabilities.Light || !capabilities.Dimmable || capabilities.Switch || capabilities.ReportsTemperature {
+		t.Fatalf("Expected a dimmable light, got %+v", capabilities)
+	}
+}
+
+func TestCapabilitySummary(t *testing.T) {
+	n := NewNetworkState(true)
+	if summary := n.CapabilitySummary(); len(summary) != 0 {
+		t.Fatalf("Expected an empty summary for an empty network, got %v", summary)
+	}
+	n.AddDevice(testDevice(1, 1))
+	dimmable := testDevice(2, 2)
+	dimmable.InputClusterIds = []uint32{OnOffCluster, LevelControlCluster}
+	n.AddDevice(dimmable)
+	sensor := testDevice(3, 3)
+	sensor.InputClusterIds = []uint32{TemperatureMeasurementCluster}
+	sensor.OutputClusterIds = []uint32{OnOffCluster}
+	n.AddDevice(sensor)
+	expected := map[string]int{"light": 2, "dimmable": 1, "temperature": 1, "switch": 1}
+	if summary := n.CapabilitySummary(); !reflect.DeepEqual(summary, expected) {
+		t.Fatalf("Expected capability counts %v, got %v", expected, summary)
+	}
+}
@@ -0,0 +1,37 @@
+package zigbee
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Codec is the interface implemented by objects able to encode and decode the network state.
+type Codec interface {
+	Marshal(*SerializedNetwork) ([]byte, error)
+	Unmarshal([]byte, *SerializedNetwork) error
+}
+
+// JSONCodec is the default codec, encoding the network state as JSON.
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(state *SerializedNetwork) ([]byte, error) {
+	return json.Marshal(state)
+}
+
+// Unmarshal will decode the JSON network state. Legacy state, made of a plain array of devices, is supported too.
+func (jsonCodec) Unmarshal(data []byte, state *SerializedNetwork) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		return json.Unmarshal(trimmed, &state.Devices)
+	}
+	return json.Unmarshal(data, state)
+}
+
+// stateCodec returns the codec used to encode the network state.
+func (n *Network) stateCodec() Codec {
+	if n.codec == nil {
+		return JSONCodec
+	}
+	return n.codec
+}
@@ -0,0 +1,44 @@
+package zigbee
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// prefixCodec encodes the network state as JSON after a prefix, counting its invocations.
+type prefixCodec struct {
+	marshals, unmarshals int
+}
+
+var codecPrefix = []byte("zigbee:")
+
+func (c *prefixCodec) Marshal(state *SerializedNetwork) ([]byte, error) {
+	c.marshals++
+	data, err := JSONCodec.Marshal(state)
+	return append(append([]byte(nil), codecPrefix...), data...), err
+}
+
+func (c *prefixCodec) Unmarshal(data []byte, state *SerializedNetwork) error {
+	c.unmarshals++
+	return JSONCodec.Unmarshal(bytes.TrimPrefix(data, codecPrefix), state)
+}
+
+func TestCustomCodec(t *testing.T) {
+	codec := &prefixCodec{}
+	n := newTestNetwork(t, WithCodec(codec))
+	populateNetwork(n)
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(n.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec.marshals != 1 || !bytes.HasPrefix(content, codecPrefix) {
+		t.Fatalf("Expected the codec to encode the state file, got %d invocations and %q", codec.marshals, content)
+	}
+	if loaded := loadNetwork(t, n.filePath, WithCodec(codec)); codec.unmarshals != 1 || !loaded.Equal(n) {
+		t.Fatalf("Expected the codec to decode the state file, got %d invocations", codec.unmarshals)
+	}
+}
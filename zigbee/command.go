@@ -7,3 +7,28 @@ type Command interface{}
 type CommandListener interface {
 	CommandReceived(Command)
 }
+
+// AddressedCommand is the interface implemented by commands addressed to a device or group.
+type AddressedCommand interface {
+	Destination() Address
+}
+
+// SourcedCommand is the interface implemented by commands tagged with the source that issued them, such as a
+// scheduler, a user or a rule engine.
+type SourcedCommand interface {
+	Source() string
+}
+
+// CommandSource returns the source of the command, or an empty string if the command is not tagged with a source.
+func CommandSource(command Command) string {
+	if sourced, ok := command.(SourcedCommand); ok {
+		return sourced.Source()
+	}
+	return ""
+}
+
+// AckListener is the type of function receiving command delivery acknowledgements. A nil error means the command
+// has been delivered successfully.
+type AckListener interface {
+	CommandAcknowledged(Command, error)
+}
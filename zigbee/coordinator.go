@@ -0,0 +1,34 @@
+package zigbee
+
+// SetCoordinator will store the coordinator device, usually the adapter with network address 0x0000. The
+// coordinator is kept apart from the other devices, so it's not returned by Devices and no device listener is
+// notified. It's persisted with the network state.
+func (n *Network) SetCoordinator(device Device) {
+	if n.rejectFrozen("coordinator update") {
+		return
+	}
+	n.devicesMx.Lock()
+	defer n.unlockDevices()
+	n.coordinator = &device
+	n.markDirty()
+	n.logDevice(walSetCoordinator, device)
+}
+
+// Coordinator will retrieve the coordinator device. The bool value is false if no coordinator has been set.
+func (n *Network) Coordinator() (Device, bool) {
+	n.devicesMx.RLock()
+	defer n.devicesMx.RUnlock()
+	if n.coordinator == nil {
+		return Device{}, false
+	}
+	return *n.coordinator, true
+}
+
+// DevicesIncludingCoordinator will retrieve a slice of all devices, followed by the coordinator device if set.
+func (n *Network) DevicesIncludingCoordinator() []Device {
+	result := n.Devices()
+	if coordinator, ok := n.Coordinator(); ok {
+		result = append(result, coordinator)
+	}
+	return result
+}
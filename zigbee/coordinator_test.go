@@ -0,0 +1,36 @@
+package zigbee
+
+import (
+	"testing"
+)
+
+func TestCoordinator(t *testing.T) {
+	n := newTestNetwork(t)
+	if _, ok := n.Coordinator(); ok {
+		t.Fatal("Expected no coordinator before it's set")
+	}
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	coordinator := testDevice(0x00124B0000000001, 0)
+	coordinator.Label = "adapter"
+	n.SetCoordinator(coordinator)
+	n.AddDevice(testDevice(1, 1))
+	if device, ok := n.Coordinator(); !ok || !device.Equal(coordinator) {
+		t.Fatalf("Expected the coordinator to be retrieved, got %v", device)
+	}
+	if devices := n.Devices(); len(devices) != 1 || devices[0].IEEEAddress != 1 {
+		t.Fatalf("Expected the coordinator to be excluded from devices, got %v", devices)
+	}
+	if devices := n.DevicesIncludingCoordinator(); len(devices) != 2 || !devices[1].Equal(coordinator) {
+		t.Fatalf("Expected the coordinator to follow the devices, got %v", devices)
+	}
+	if events := listener.Events(); len(events) != 1 {
+		t.Fatalf("Expected no notification for the coordinator, got %v", events)
+	}
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if device, ok := loadNetwork(t, n.filePath).Coordinator(); !ok || !device.Equal(coordinator) {
+		t.Fatalf("Expected the coordinator to be persisted, got %v", device)
+	}
+}
@@ -0,0 +1,43 @@
+package zigbee
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// csvHeader is the header row written by WriteCSV.
+var csvHeader = []string{
+	"ieeeAddress", "label", "networkAddress", "endpoint", "deviceType", "manufacturerCode",
+	"inputClusters", "outputClusters",
+}
+
+// WriteCSV will write the network devices to w as CSV, one row per device sorted by network address, after a header
+// row. IEEE addresses are written as hex strings.
+func (n *Network) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(csvHeader); err != nil {
+		return wrapError(CodeIO, err, "Unable to write CSV header")
+	}
+	for _, device := range n.DevicesSorted() {
+		row := []string{
+			fmt.Sprintf("0x%016x", device.IEEEAddress),
+			device.Label,
+			strconv.FormatUint(uint64(device.NetworkAddress.NetworkAddress), 10),
+			strconv.FormatUint(uint64(device.NetworkAddress.Endpoint), 10),
+			strconv.FormatUint(uint64(device.DeviceType), 10),
+			strconv.FormatUint(uint64(device.ManufacturerCode), 10),
+			strconv.Itoa(len(device.InputClusterIds)),
+			strconv.Itoa(len(device.OutputClusterIds)),
+		}
+		if err := writer.Write(row); err != nil {
+			return wrapError(CodeIO, err, fmt.Sprintf("Unable to write CSV row of device %s", device.NetworkAddress))
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return wrapError(CodeIO, err, "Unable to write CSV")
+	}
+	return nil
+}
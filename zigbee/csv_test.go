@@ -0,0 +1,30 @@
+package zigbee
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteCSV(t *testing.T) {
+	n := NewNetworkState(true)
+	second := testDevice(0x00124B0001ABCDEF, 0x1234)
+	second.Label = "Kitchen, ceiling"
+	second.DeviceType = 1
+	second.ManufacturerCode = 4476
+	second.InputClusterIds = []uint32{OnOffCluster, LevelControlCluster}
+	n.AddDevice(second)
+	n.AddDevice(testDevice(2, 1))
+	var buffer bytes.Buffer
+	if err := n.WriteCSV(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	expected := "ieeeAddress,label,networkAddress,endpoint,deviceType,manufacturerCode,inputClusters,outputClusters\n" +
+		"0x0000000000000002,,1,1,0,0,1,0\n" +
+		"0x00124b0001abcdef,\"Kitchen, ceiling\",4660,1,1,4476,2,0\n"
+	if buffer.String() != expected {
+		t.Fatalf("Expected CSV\n%s\ngot\n%s", expected, buffer.String())
+	}
+	if err := n.WriteCSV(failingWriter{}); CodeOf(err) != CodeIO {
+		t.Fatalf("Expected an IO error writing to a failing writer, got %v", err)
+	}
+}
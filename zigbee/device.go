@@ -1,19 +1,35 @@
 package zigbee
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // Device will represent a zigbee device.
 type Device struct {
-	IEEEAddress      uint64        `json:"ieeeAddress"`
-	NetworkAddress   DeviceAddress `json:"networkAddress"`
-	ProfileID        uint32        `json:"profileId"`
-	DeviceType       uint32        `json:"deviceType"`
-	DeviceID         uint32        `json:"deviceId"`
-	ManufacturerCode uint32        `json:"manufacturerCode"`
-	DeviceVersion    uint32        `json:"deviceVersion"`
-	InputClusterIds  []uint32      `json:"inputClusterIds"`
-	OutputClusterIds []uint32      `json:"outputClusterIds"`
-	Label            string        `json:"label"`
+	IEEEAddress      uint64            `json:"ieeeAddress"`
+	NetworkAddress   DeviceAddress     `json:"networkAddress"`
+	ProfileID        uint32            `json:"profileId"`
+	DeviceType       uint32            `json:"deviceType"`
+	DeviceID         uint32            `json:"deviceId"`
+	ManufacturerCode uint32            `json:"manufacturerCode"`
+	DeviceVersion    uint32            `json:"deviceVersion"`
+	InputClusterIds  []uint32          `json:"inputClusterIds"`
+	OutputClusterIds []uint32          `json:"outputClusterIds"`
+	Label            string            `json:"label"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+	LastSeen         time.Time         `json:"lastSeen"`
+	// Attributes caches the last reported attribute values, keyed by cluster id and then by attribute id.
+	Attributes map[uint32]map[uint32]interface{} `json:"attributes,omitempty"`
+	// Transient devices are kept in memory only, and never persisted with the network state.
+	Transient bool `json:"transient,omitempty"`
+	// Disabled devices are kept in the network, but commands addressed to them are not dispatched. The field has
+	// inverse semantics so that devices are enabled by default.
+	Disabled bool `json:"disabled,omitempty"`
 }
 
 func (d Device) String() string {
@@ -31,3 +47,219 @@ func (d Device) String() string {
 		d.OutputClusterIds,
 	)
 }
+
+// Equal will check if the device is equal to the other one. Nil and empty slices or maps are considered equal.
+func (d Device) Equal(other Device) bool {
+	return d.IEEEAddress == other.IEEEAddress &&
+		d.NetworkAddress == other.NetworkAddress &&
+		d.ProfileID == other.ProfileID &&
+		d.DeviceType == other.DeviceType &&
+		d.DeviceID == other.DeviceID &&
+		d.ManufacturerCode == other.ManufacturerCode &&
+		d.DeviceVersion == other.DeviceVersion &&
+		d.Label == other.Label &&
+		d.LastSeen.Equal(other.LastSeen) &&
+		d.Transient == other.Transient &&
+		d.Disabled == other.Disabled &&
+		equalClusterIds(d.InputClusterIds, other.InputClusterIds) &&
+		equalClusterIds(d.OutputClusterIds, other.OutputClusterIds) &&
+		equalMetadata(d.Metadata, other.Metadata) &&
+		equalAttributes(d.Attributes, other.Attributes)
+}
+
+// MarshalJSON will implement custom JSON serialization. Nil cluster id slices are serialized as empty arrays, while
+// both null and empty arrays are accepted on deserialization. The IEEE address is serialized as hex string and a zero
+// last seen time is omitted.
+func (d Device) MarshalJSON() ([]byte, error) {
+	// serializedDevice has no methods, so it's serialized with the default encoding
+	type serializedDevice Device
+	if d.InputClusterIds == nil {
+		d.InputClusterIds = []uint32{}
+	}
+	if d.OutputClusterIds == nil {
+		d.OutputClusterIds = []uint32{}
+	}
+	// The outer fields shadow the embedded ones, since omitempty has no effect on time.Time
+	state := struct {
+		IEEEAddress ieeeAddressJSON `json:"ieeeAddress"`
+		serializedDevice
+		LastSeen *time.Time `json:"lastSeen,omitempty"`
+	}{IEEEAddress: ieeeAddressJSON(d.IEEEAddress), serializedDevice: serializedDevice(d)}
+	if !d.LastSeen.IsZero() {
+		state.LastSeen = &d.LastSeen
+	}
+	return json.Marshal(state)
+}
+
+// UnmarshalJSON will implement custom JSON deserialization. The IEEE address is accepted both as hex string and as
+// number, as serialized by previous versions.
+func (d *Device) UnmarshalJSON(data []byte) error {
+	type serializedDevice Device
+	state := struct {
+		*serializedDevice
+		IEEEAddress ieeeAddressJSON `json:"ieeeAddress"`
+	}{serializedDevice: (*serializedDevice)(d)}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	d.IEEEAddress = uint64(state.IEEEAddress)
+	return nil
+}
+
+// ieeeAddressJSON is an IEEE address serialized as hex string, since JSON numbers above 2^53 lose precision in many
+// consumers.
+type ieeeAddressJSON uint64
+
+func (a ieeeAddressJSON) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("0x%016x", uint64(a)))
+}
+
+func (a *ieeeAddressJSON) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		var number uint64
+		if err := json.Unmarshal(data, &number); err != nil {
+			return newCodedErrorWithCause(CodeInvalid, fmt.Sprintf("Invalid IEEE address %s", data), err)
+		}
+		*a = ieeeAddressJSON(number)
+		return nil
+	}
+	text = strings.TrimPrefix(strings.TrimPrefix(text, "0x"), "0X")
+	value, err := strconv.ParseUint(text, 16, 64)
+	if err != nil {
+		return newCodedErrorWithCause(CodeInvalid, fmt.Sprintf("Invalid IEEE address %s", data), err)
+	}
+	*a = ieeeAddressJSON(value)
+	return nil
+}
+
+// Enabled will check if the device is enabled, so that commands addressed to it are dispatched.
+func (d Device) Enabled() bool {
+	return !d.Disabled
+}
+
+// MaxClusterID is the highest ZCL cluster id, since cluster ids are 16-bit.
+const MaxClusterID uint32 = 0xFFFF
+
+// Validate will check that the device is well formed: cluster ids must be 16-bit, ZDO devices must have no
+// application clusters and other devices must have at least one cluster.
+func (d Device) Validate() error {
+	for _, id := range d.InputClusterIds {
+		if id > MaxClusterID {
+			return newCodedError(CodeInvalid, fmt.Sprintf("Device %s has input cluster id 0x%x outside the 16-bit range", d.NetworkAddress, id))
+		}
+	}
+	for _, id := range d.OutputClusterIds {
+		if id > MaxClusterID {
+			return newCodedError(CodeInvalid, fmt.Sprintf("Device %s has output cluster id 0x%x outside the 16-bit range", d.NetworkAddress, id))
+		}
+	}
+	clusters := len(d.InputClusterIds) + len(d.OutputClusterIds)
+	if d.IsZDO() && clusters > 0 {
+		return newCodedError(CodeInvalid, fmt.Sprintf("ZDO device %s has %d application clusters", d.NetworkAddress, clusters))
+	}
+	if !d.IsZDO() && clusters == 0 {
+		return newCodedError(CodeInvalid, fmt.Sprintf("Device %s has no clusters", d.NetworkAddress))
+	}
+	return nil
+}
+
+// WithNetworkAddress will return a copy of the device with the supplied network address.
+// Cluster slices are copied, so the returned device shares no state with the original.
+func (d Device) WithNetworkAddress(address DeviceAddress) Device {
+	clone := d
+	clone.NetworkAddress = address
+	clone.InputClusterIds = cloneClusterIds(d.InputClusterIds)
+	clone.OutputClusterIds = cloneClusterIds(d.OutputClusterIds)
+	clone.Metadata = cloneMetadata(d.Metadata)
+	clone.Attributes = cloneAttributes(d.Attributes)
+	return clone
+}
+
+func cloneMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	clone := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		clone[key] = value
+	}
+	return clone
+}
+
+// cloneAttributes will copy the attribute maps. Values are shared, so they should not be mutated once stored.
+func cloneAttributes(attributes map[uint32]map[uint32]interface{}) map[uint32]map[uint32]interface{} {
+	if attributes == nil {
+		return nil
+	}
+	clone := make(map[uint32]map[uint32]interface{}, len(attributes))
+	for cluster, values := range attributes {
+		clone[cluster] = make(map[uint32]interface{}, len(values))
+		for attribute, value := range values {
+			clone[cluster][attribute] = value
+		}
+	}
+	return clone
+}
+
+func cloneClusterIds(ids []uint32) []uint32 {
+	if ids == nil {
+		return nil
+	}
+	clone := make([]uint32, len(ids))
+	copy(clone, ids)
+	return clone
+}
+
+// IsZDO will check if the device is the ZigBee Device Object endpoint.
+func (d Device) IsZDO() bool {
+	return d.NetworkAddress.Endpoint == ZDOEndpoint
+}
+
+// IsApplicationEndpoint will check if the device endpoint is in the application endpoints range.
+func (d Device) IsApplicationEndpoint() bool {
+	endpoint := d.NetworkAddress.Endpoint
+	return endpoint >= MinApplicationEndpoint && endpoint <= MaxApplicationEndpoint
+}
+
+func equalClusterIds(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalMetadata(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+func equalAttributes(a, b map[uint32]map[uint32]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for cluster, values := range a {
+		other, ok := b[cluster]
+		if !ok || len(values) != len(other) {
+			return false
+		}
+		for attribute, value := range values {
+			if otherValue, ok := other[attribute]; !ok || !reflect.DeepEqual(value, otherValue) {
+				return false
+			}
+		}
+	}
+	return true
+}
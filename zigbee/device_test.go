@@ -0,0 +1,322 @@
+package zigbee
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func TestWithNetworkAddress(t *testing.T) {
+	original := testDevice(1, 1)
+	original.OutputClusterIds = []uint32{LevelControlCluster}
+	original.Metadata = map[string]string{"room": "kitchen"}
+	clone := original.WithNetworkAddress(NewDeviceAddress(2, 1))
+	if clone.NetworkAddress != NewDeviceAddress(2, 1) || original.NetworkAddress != NewDeviceAddress(1, 1) {
+		t.Fatalf("Expected only the clone to have the new address, got %s and %s", clone.NetworkAddress, original.NetworkAddress)
+	}
+	clone.InputClusterIds[0] = 0xffff
+	clone.OutputClusterIds[0] = 0xffff
+	clone.Metadata["room"] = "garden"
+	if original.InputClusterIds[0] != OnOffCluster || original.OutputClusterIds[0] != LevelControlCluster {
+		t.Fatalf("Expected original cluster slices to be unchanged, got %v", original)
+	}
+	if original.Metadata["room"] != "kitchen" {
+		t.Fatalf("Expected original metadata to be unchanged, got %v", original.Metadata)
+	}
+}
+
+func TestEndpointHelpers(t *testing.T) {
+	for _, test := range []struct {
+		endpoint    uint32
+		zdo         bool
+		application bool
+	}{
+		{0, true, false},
+		{1, false, true},
+		{240, false, true},
+		{241, false, false},
+	} {
+		device := Device{NetworkAddress: NewDeviceAddress(1, test.endpoint)}
+		if device.IsZDO() != test.zdo || device.IsApplicationEndpoint() != test.application {
+			t.Errorf("Endpoint %d: expected ZDO %t and application %t", test.endpoint, test.zdo, test.application)
+		}
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	n := newTestNetwork(t)
+	n.AddDevice(testDevice(1, 1))
+	if !n.SetMetadata(1, "room", "kitchen") {
+		t.Fatal("Expected metadata to be set on existing device")
+	}
+	if n.SetMetadata(2, "room", "kitchen") {
+		t.Fatal("Expected metadata not to be set on missing device")
+	}
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewNetworkState(false)
+	loaded.filePath = n.filePath
+	if err := loaded.Startup(); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := loaded.Metadata(1, "room"); !ok || value != "kitchen" {
+		t.Fatalf("Expected metadata to survive save and load, got %q", value)
+	}
+	if _, ok := loaded.Metadata(1, "vendor"); ok {
+		t.Fatal("Expected missing metadata key not to be found")
+	}
+}
+
+func TestMetadataMissingInStateFile(t *testing.T) {
+	n := newTestNetwork(t)
+	state := `{"devices":[{"ieeeAddress":1,"networkAddress":{"networkAddress":1,"endpoint":1},"inputClusterIds":[6]}]}`
+	if err := ioutil.WriteFile(n.filePath, []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewNetworkState(false)
+	loaded.filePath = n.filePath
+	if err := loaded.Startup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.Device(NewDeviceAddress(1, 1)); !ok {
+		t.Fatal("Expected device saved without metadata to be loaded")
+	}
+	if _, ok := loaded.Metadata(1, "room"); ok {
+		t.Fatal("Expected no metadata for devices saved without it")
+	}
+}
+
+func TestIEEEOperationsUseLowestEndpoint(t *testing.T) {
+	n := newTestNetwork(t)
+	for endpoint := uint32(5); endpoint > 0; endpoint-- {
+		device := testDevice(1, 1)
+		device.NetworkAddress = NewDeviceAddress(1, endpoint)
+		n.AddDevice(device)
+	}
+	for i := 0; i < 20; i++ {
+		value := fmt.Sprint(i)
+		n.SetMetadata(1, "round", value)
+		if read, _ := n.Metadata(1, "round"); read != value {
+			t.Fatalf("Expected metadata %q to be read back, got %q", value, read)
+		}
+	}
+	n.SetDeviceLabel(1, "lamp")
+	if device, _ := n.Device(NewDeviceAddress(1, 1)); device.Label != "lamp" {
+		t.Fatalf("Expected the lowest endpoint to be labelled, got %v", device)
+	}
+	n.RemoveDeviceByIEEE(1)
+	if _, ok := n.Device(NewDeviceAddress(1, 1)); ok {
+		t.Fatal("Expected the lowest endpoint to be removed")
+	}
+	if _, ok := n.Device(NewDeviceAddress(1, 2)); !ok {
+		t.Fatal("Expected the other endpoints to be kept")
+	}
+}
+
+func TestDeviceJSONClusterSlices(t *testing.T) {
+	for _, test := range []struct {
+		clusters []uint32
+		json     string
+	}{
+		{nil, `"inputClusterIds":[]`},
+		{[]uint32{}, `"inputClusterIds":[]`},
+		{[]uint32{OnOffCluster, LevelControlCluster}, `"inputClusterIds":[6,8]`},
+	} {
+		device := testDevice(1, 1)
+		device.InputClusterIds = test.clusters
+		data, err := json.Marshal(device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(data, []byte(test.json)) || !bytes.Contains(data, []byte(`"outputClusterIds":[]`)) {
+			t.Fatalf("Expected %s and empty output clusters, got %s", test.json, data)
+		}
+		var decoded Device
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded.InputClusterIds) != len(test.clusters) || !decoded.Equal(device) {
+			t.Fatalf("Expected %v to survive the round trip, got %v", device, decoded)
+		}
+	}
+	var decoded Device
+	if err := json.Unmarshal([]byte(`{"inputClusterIds":null,"outputClusterIds":null}`), &decoded); err != nil {
+		t.Fatalf("Expected null cluster ids to be accepted, got %v", err)
+	}
+}
+
+func TestAddDeviceCheckedIEEECollision(t *testing.T) {
+	n := NewNetworkState(true)
+	if err := n.AddDeviceChecked(testDevice(1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	updated := testDevice(1, 1)
+	updated.Label = "lamp"
+	if err := n.AddDeviceChecked(updated); err != nil {
+		t.Fatalf("Expected the device with the same key to be replaced, got %v", err)
+	}
+	endpoint := testDevice(1, 1)
+	endpoint.NetworkAddress = NewDeviceAddress(1, 2)
+	if err := n.AddDeviceChecked(endpoint); err != nil {
+		t.Fatalf("Expected another endpoint of the same node to be added, got %v", err)
+	}
+	if err := n.AddDeviceChecked(testDevice(1, 2)); CodeOf(err) != CodeConflict {
+		t.Fatalf("Expected a conflict adding a device with a used IEEE address, got %v", err)
+	}
+	if _, ok := n.Device(NewDeviceAddress(2, 1)); ok {
+		t.Fatal("Expected the colliding device not to be added")
+	}
+	if device, _ := n.Device(NewDeviceAddress(1, 1)); device.Label != "lamp" {
+		t.Fatalf("Expected the existing device to be updated, got %v", device)
+	}
+}
+
+func TestResolveByAny(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddDevice(testDevice(1, 0x20))
+	n.AddDevice(testDevice(2, 0x10))
+	stale := NewDeviceAddress(0x10, 1)
+	if device, ok := n.ResolveByAny(1, stale); !ok || device.NetworkAddress != NewDeviceAddress(0x20, 1) {
+		t.Fatalf("Expected the device to be resolved by IEEE address after rejoin, got %v", device)
+	}
+	if device, ok := n.ResolveByAny(3, stale); !ok || device.IEEEAddress != 2 {
+		t.Fatalf("Expected the network address to be used for unknown IEEE addresses, got %v", device)
+	}
+	if _, ok := n.ResolveByAny(3, NewDeviceAddress(0x30, 1)); ok {
+		t.Fatal("Expected no device to be resolved")
+	}
+	endpoint := testDevice(1, 0x20)
+	endpoint.NetworkAddress = NewDeviceAddress(0x20, 2)
+	n.AddDevice(endpoint)
+	if device, _ := n.ResolveByAny(1, NewDeviceAddress(0x10, 2)); device.NetworkAddress != endpoint.NetworkAddress {
+		t.Fatalf("Expected the matching endpoint to be resolved, got %v", device)
+	}
+	if device, _ := n.ResolveByAny(1, NewDeviceAddress(0x10, 3)); device.NetworkAddress != NewDeviceAddress(0x20, 1) {
+		t.Fatalf("Expected the lowest endpoint to be resolved, got %v", device)
+	}
+}
+
+func TestCustomDeviceKey(t *testing.T) {
+	n := newTestNetwork(t, WithDeviceKey(func(d Device) string {
+		return fmt.Sprintf("%x/%d", d.IEEEAddress, d.NetworkAddress.Endpoint)
+	}))
+	n.AddDevice(testDevice(1, 1))
+	n.AddDevice(testDevice(2, 1))
+	if len(n.Devices()) != 2 {
+		t.Fatalf("Expected devices with colliding network addresses to coexist, got %v", n.Devices())
+	}
+	updated := testDevice(2, 1)
+	updated.Label = "lamp"
+	n.UpdateDevice(updated)
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := loadNetwork(t, n.filePath, WithDeviceKey(func(d Device) string {
+		return fmt.Sprintf("%x/%d", d.IEEEAddress, d.NetworkAddress.Endpoint)
+	}))
+	if !loaded.Equal(n) || len(loaded.Devices()) != 2 {
+		t.Fatalf("Expected colliding devices to survive save and load, got %v", loaded.Devices())
+	}
+	n.RemoveDevice(testDevice(1, 1))
+	if devices := n.Devices(); len(devices) != 1 || devices[0].Label != "lamp" {
+		t.Fatalf("Expected only the removed device to be removed, got %v", devices)
+	}
+}
+
+func TestValidateEndpointClusters(t *testing.T) {
+	zdo := Device{IEEEAddress: 1, NetworkAddress: NewZDOAddress(1)}
+	if err := zdo.Validate(); err != nil {
+		t.Fatalf("Expected a ZDO device without clusters to be valid, got %v", err)
+	}
+	zdo.InputClusterIds = []uint32{OnOffCluster}
+	if err := zdo.Validate(); CodeOf(err) != CodeInvalid {
+		t.Fatalf("Expected a ZDO device with clusters to be invalid, got %v", err)
+	}
+	application := Device{IEEEAddress: 1, NetworkAddress: NewDeviceAddress(1, 1)}
+	if err := application.Validate(); CodeOf(err) != CodeInvalid {
+		t.Fatalf("Expected an application device without clusters to be invalid, got %v", err)
+	}
+	application.OutputClusterIds = []uint32{OnOffCluster}
+	if err := application.Validate(); err != nil {
+		t.Fatalf("Expected an application device with clusters to be valid, got %v", err)
+	}
+	n := NewNetworkState(true)
+	n.AddDevice(zdo)
+	if problems := n.CheckIntegrity(); len(problems) != 1 || CodeOf(problems[0]) != CodeInvalid {
+		t.Fatalf("Expected integrity check to report the invalid device, got %v", problems)
+	}
+}
+
+func TestSetDeviceVersion(t *testing.T) {
+	n := NewNetworkState(true)
+	device := testDevice(1, 1)
+	device.Label = "lamp"
+	device.DeviceVersion = 1
+	device.Metadata = map[string]string{"room": "kitchen"}
+	n.AddDevice(device)
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	if !n.SetDeviceVersion(1, device.DeviceVersion+1) {
+		t.Fatal("Expected the version of an existing device to be set")
+	}
+	updated, _ := n.Device(device.NetworkAddress)
+	device.DeviceVersion = 2
+	if !updated.Equal(device) {
+		t.Fatalf("Expected only the version to change, got %v", updated)
+	}
+	if events := listener.Events(); len(events) != 1 || events[0] != "updated 1/1" {
+		t.Fatalf("Expected the update to be notified, got %v", events)
+	}
+	if n.SetDeviceVersion(2, 1) {
+		t.Fatal("Expected no version to be set on missing device")
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	n := newTestNetwork(t)
+	n.AddDevice(testDevice(1, 1))
+	if !n.SetAttribute(1, OnOffCluster, 0, true) || !n.SetAttribute(1, LevelControlCluster, 0, 128) {
+		t.Fatal("Expected attributes to be set on existing device")
+	}
+	if n.SetAttribute(2, OnOffCluster, 0, true) {
+		t.Fatal("Expected attributes not to be set on missing device")
+	}
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := loadNetwork(t, n.filePath)
+	if value, ok := loaded.GetAttribute(1, OnOffCluster, 0); !ok || value != true {
+		t.Fatalf("Expected the on/off attribute to survive save and load, got %v", value)
+	}
+	if value, ok := loaded.GetAttribute(1, LevelControlCluster, 0); !ok || value != float64(128) {
+		t.Fatalf("Expected the level attribute to be restored as float64, got %#v", value)
+	}
+	if _, ok := loaded.GetAttribute(1, OnOffCluster, 1); ok {
+		t.Fatal("Expected missing attributes not to be found")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				n.SetAttribute(1, LevelControlCluster, uint32(i), j)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				n.GetAttribute(1, LevelControlCluster, uint32(i))
+				n.Devices()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if value, _ := n.GetAttribute(1, LevelControlCluster, 3); value != 49 {
+		t.Fatalf("Expected the last value written, got %v", value)
+	}
+}
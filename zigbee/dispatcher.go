@@ -0,0 +1,216 @@
+package zigbee
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// CorrelationToken identifies a command waiting for a response.
+type CorrelationToken uint64
+
+// CorrelatedCommand is the command delivered to command listeners when a response is expected. The response must be
+// submitted with the same token using SubmitResponse.
+type CorrelatedCommand struct {
+	Token   CorrelationToken
+	Command Command
+}
+
+// Source returns the source of the correlated command.
+func (c CorrelatedCommand) Source() string {
+	return CommandSource(c.Command)
+}
+
+// commandRegistration is a command listener registered with the command sources it accepts.
+type commandRegistration struct {
+	listener CommandListener
+	sources  map[string]bool
+}
+
+// accepts will check if the command source is accepted by the listener. Listeners registered without sources
+// accept all commands, and commands without source are accepted by all listeners.
+func (r commandRegistration) accepts(command Command) bool {
+	if r.sources == nil {
+		return true
+	}
+	source := CommandSource(command)
+	return source == "" || r.sources[source]
+}
+
+// AddCommandListener will add a command listener. A nil listener is ignored.
+func (n *Network) AddCommandListener(listener CommandListener) {
+	n.addCommandListener(listener, nil)
+}
+
+// AddCommandListenerForSources will add a command listener receiving only the commands issued by the supplied
+// sources, and the commands without source. A nil listener is ignored.
+func (n *Network) AddCommandListenerForSources(listener CommandListener, sources ...string) {
+	accepted := make(map[string]bool, len(sources))
+	for _, source := range sources {
+		accepted[source] = true
+	}
+	n.addCommandListener(listener, accepted)
+}
+
+func (n *Network) addCommandListener(listener CommandListener, sources map[string]bool) {
+	if listener == nil {
+		return
+	}
+	n.commandListenersMx.Lock()
+	defer n.commandListenersMx.Unlock()
+	for _, r := range n.commandListeners {
+		if sameListener(r.listener, listener) {
+			return
+		}
+	}
+	n.commandListeners = append(n.commandListeners, commandRegistration{listener: listener, sources: sources})
+}
+
+// RemoveCommandListener will remove a command listener.
+func (n *Network) RemoveCommandListener(listener CommandListener) {
+	n.commandListenersMx.Lock()
+	defer n.commandListenersMx.Unlock()
+	for i, r := range n.commandListeners {
+		if sameListener(r.listener, listener) {
+			last := len(n.commandListeners) - 1
+			copy(n.commandListeners[i:], n.commandListeners[i+1:])
+			n.commandListeners[last] = commandRegistration{}
+			n.commandListeners = n.commandListeners[:last]
+			return
+		}
+	}
+}
+
+// CommandListenerCount returns the number of registered command listeners.
+func (n *Network) CommandListenerCount() int {
+	n.commandListenersMx.RLock()
+	defer n.commandListenersMx.RUnlock()
+	return len(n.commandListeners)
+}
+
+// DispatchCommand will deliver the command to all command listeners accepting its source. Addressed commands whose
+// destination is a disabled device are discarded. Commands accepted by no listener are delivered to the unhandled
+// command handler, if any.
+func (n *Network) DispatchCommand(command Command) {
+	if n.disabledDestination(command) {
+		log.Printf("Discarding command %v addressed to disabled device.", command)
+		return
+	}
+	n.commandListenersMx.RLock()
+	defer n.commandListenersMx.RUnlock()
+	handled := false
+	for i := range n.commandListeners {
+		r := n.commandListeners[n.listenerIndex(i, len(n.commandListeners))]
+		if r.listener != nil && r.accepts(command) {
+			r.listener.CommandReceived(command)
+			handled = true
+		}
+	}
+	if !handled && n.unhandledHandler != nil {
+		n.unhandledHandler(command)
+	}
+}
+
+// SetUnhandledCommandHandler will set the handler receiving the commands accepted by no command listener, for
+// logging or dead-lettering. A nil handler removes the current one.
+func (n *Network) SetUnhandledCommandHandler(handler func(Command)) {
+	n.commandListenersMx.Lock()
+	defer n.commandListenersMx.Unlock()
+	n.unhandledHandler = handler
+}
+
+// AddAckListener will add a command acknowledgement listener. A nil listener is ignored.
+func (n *Network) AddAckListener(listener AckListener) {
+	if listener == nil {
+		return
+	}
+	n.commandListenersMx.Lock()
+	defer n.commandListenersMx.Unlock()
+	for _, l := range n.ackListeners {
+		if sameListener(l, listener) {
+			return
+		}
+	}
+	n.ackListeners = append(n.ackListeners, listener)
+}
+
+// RemoveAckListener will remove a command acknowledgement listener.
+func (n *Network) RemoveAckListener(listener AckListener) {
+	n.commandListenersMx.Lock()
+	defer n.commandListenersMx.Unlock()
+	for i, l := range n.ackListeners {
+		if sameListener(l, listener) {
+			last := len(n.ackListeners) - 1
+			copy(n.ackListeners[i:], n.ackListeners[i+1:])
+			n.ackListeners[last] = nil
+			n.ackListeners = n.ackListeners[:last]
+			return
+		}
+	}
+}
+
+// NotifyAck will deliver the result of the command delivery to all acknowledgement listeners. Transport layers use
+// it to report whether the command has been delivered, a nil error meaning success.
+func (n *Network) NotifyAck(command Command, err error) {
+	n.commandListenersMx.RLock()
+	defer n.commandListenersMx.RUnlock()
+	for i := range n.ackListeners {
+		n.ackListeners[n.listenerIndex(i, len(n.ackListeners))].CommandAcknowledged(command, err)
+	}
+}
+
+// disabledDestination will check if the command is addressed to a disabled device. Commands with a nil destination
+// are not addressed to any device.
+func (n *Network) disabledDestination(command Command) bool {
+	addressed, ok := command.(AddressedCommand)
+	if !ok || addressed.Destination() == nil {
+		return false
+	}
+	device, ok := n.Device(addressed.Destination())
+	return ok && !device.Enabled()
+}
+
+// DispatchWithResponse will deliver the command to all command listeners as a CorrelatedCommand, waiting for the
+// response submitted with its token. An error is returned if the command is addressed to a disabled device, or if
+// the context is done before a response is submitted.
+func (n *Network) DispatchWithResponse(ctx context.Context, command Command) (Command, error) {
+	if n.disabledDestination(command) {
+		return nil, newCodedError(CodeDisabled, fmt.Sprintf("Command %v is addressed to a disabled device", command))
+	}
+	responses := make(chan Command, 1)
+	n.pendingMx.Lock()
+	if n.pending == nil {
+		n.pending = make(map[CorrelationToken]chan Command)
+	}
+	n.nextToken++
+	token := n.nextToken
+	n.pending[token] = responses
+	n.pendingMx.Unlock()
+	defer func() {
+		n.pendingMx.Lock()
+		delete(n.pending, token)
+		n.pendingMx.Unlock()
+	}()
+
+	n.DispatchCommand(CorrelatedCommand{Token: token, Command: command})
+	select {
+	case response := <-responses:
+		return response, nil
+	case <-ctx.Done():
+		return nil, newCodedErrorWithCause(CodeTimeout, fmt.Sprintf("No response received for command with token %d", token), ctx.Err())
+	}
+}
+
+// SubmitResponse will deliver the response to the command waiting with the supplied token. An error is returned if
+// no command is waiting for the token.
+func (n *Network) SubmitResponse(token CorrelationToken, response Command) error {
+	n.pendingMx.Lock()
+	defer n.pendingMx.Unlock()
+	responses, ok := n.pending[token]
+	if !ok {
+		return newCodedError(CodeNotFound, fmt.Sprintf("No command is waiting for a response with token %d", token))
+	}
+	delete(n.pending, token)
+	responses <- response
+	return nil
+}
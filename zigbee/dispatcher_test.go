@@ -0,0 +1,176 @@
+package zigbee
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// commandFunc adapts a function to the CommandListener interface.
+type commandFunc func(Command)
+
+func (f commandFunc) CommandReceived(command Command) { f(command) }
+
+func TestDispatchWithResponse(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddCommandListener(commandFunc(func(command Command) {
+		correlated := command.(CorrelatedCommand)
+		if err := n.SubmitResponse(correlated.Token, "pong"); err != nil {
+			t.Error(err)
+		}
+	}))
+	response, err := n.DispatchWithResponse(context.Background(), "ping")
+	if err != nil || response != "pong" {
+		t.Fatalf("Expected the submitted response, got %v and error %v", response, err)
+	}
+}
+
+func TestDispatchWithResponseTimeout(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddCommandListener(commandFunc(func(Command) {}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := n.DispatchWithResponse(ctx, "ping"); CodeOf(err) != CodeTimeout {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+}
+
+func TestDispatchWithResponseMismatchedToken(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddCommandListener(commandFunc(func(command Command) {
+		correlated := command.(CorrelatedCommand)
+		if err := n.SubmitResponse(correlated.Token+1, "pong"); CodeOf(err) != CodeNotFound {
+			t.Errorf("Expected a not found error for a mismatched token, got %v", err)
+		}
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if response, err := n.DispatchWithResponse(ctx, "ping"); CodeOf(err) != CodeTimeout {
+		t.Fatalf("Expected the mismatched response to be ignored, got %v and error %v", response, err)
+	}
+}
+
+// ackRecorder records the acknowledged commands and their errors.
+type ackRecorder struct {
+	recordingListener
+}
+
+func (l *ackRecorder) CommandAcknowledged(command Command, err error) {
+	l.record("ack %v %v", command, err)
+}
+
+func TestAckListeners(t *testing.T) {
+	n := NewNetworkState(true)
+	first, second := &ackRecorder{}, &ackRecorder{}
+	n.AddAckListener(first)
+	n.AddAckListener(second)
+	n.NotifyAck("on", nil)
+	n.NotifyAck("off", errors.New("timeout"))
+	expected := []string{"ack on <nil>", "ack off timeout"}
+	for _, listener := range []*ackRecorder{first, second} {
+		if events := listener.Events(); !reflect.DeepEqual(events, expected) {
+			t.Fatalf("Expected acknowledgements %v, got %v", expected, events)
+		}
+	}
+	n.RemoveAckListener(first)
+	n.NotifyAck("toggle", nil)
+	if len(first.Events()) != 2 || len(second.Events()) != 3 {
+		t.Fatalf("Expected removed listeners not to be notified, got %v and %v", first.Events(), second.Events())
+	}
+}
+
+// testCommand is a command addressed to a destination and tagged with a source.
+type testCommand struct {
+	destination Address
+	source      string
+}
+
+func (c testCommand) Destination() Address { return c.destination }
+func (c testCommand) Source() string       { return c.source }
+
+func TestDisabledDevicesSkipDispatch(t *testing.T) {
+	n := newTestNetwork(t)
+	n.AddDevice(testDevice(1, 1))
+	n.AddDevice(testDevice(2, 2))
+	var received []Command
+	n.AddCommandListener(commandFunc(func(command Command) {
+		received = append(received, command)
+	}))
+	if !n.SetDeviceEnabled(1, false) || n.SetDeviceEnabled(3, false) {
+		t.Fatal("Expected only existing devices to be disabled")
+	}
+	disabled := testCommand{destination: NewDeviceAddress(1, 1)}
+	enabled := testCommand{destination: NewDeviceAddress(2, 1)}
+	unaddressed := testCommand{source: "user"}
+	n.DispatchCommand(disabled)
+	n.DispatchCommand(enabled)
+	n.DispatchCommand(unaddressed)
+	if !reflect.DeepEqual(received, []Command{enabled, unaddressed}) {
+		t.Fatalf("Expected only the commands not addressed to disabled devices to be dispatched, got %v", received)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := n.DispatchWithResponse(ctx, disabled); err == nil {
+		t.Fatal("Expected commands with response to disabled devices to be rejected")
+	}
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := loadNetwork(t, n.filePath)
+	if device, _ := loaded.Device(NewDeviceAddress(1, 1)); device.Enabled() {
+		t.Fatal("Expected the disabled flag to be persisted")
+	}
+	if device, _ := loaded.Device(NewDeviceAddress(2, 1)); !device.Enabled() {
+		t.Fatal("Expected devices to be enabled by default")
+	}
+}
+
+func TestCommandSourceFilter(t *testing.T) {
+	n := NewNetworkState(true)
+	var all, filtered []Command
+	n.AddCommandListener(commandFunc(func(command Command) {
+		all = append(all, command)
+	}))
+	n.AddCommandListenerForSources(commandFunc(func(command Command) {
+		filtered = append(filtered, command)
+	}), "user", "rule")
+	user := testCommand{source: "user"}
+	rule := testCommand{source: "rule"}
+	scheduler := testCommand{source: "scheduler"}
+	for _, command := range []Command{user, scheduler, rule, "unsourced"} {
+		n.DispatchCommand(command)
+	}
+	if !reflect.DeepEqual(filtered, []Command{user, rule, "unsourced"}) {
+		t.Fatalf("Expected only accepted sources and unsourced commands, got %v", filtered)
+	}
+	if len(all) != 4 {
+		t.Fatalf("Expected unfiltered listeners to receive every command, got %v", all)
+	}
+	if CommandSource(scheduler) != "scheduler" || CommandSource("unsourced") != "" {
+		t.Fatal("Expected the command source to be reported")
+	}
+}
+
+func TestUnhandledCommandHandler(t *testing.T) {
+	n := NewNetworkState(true)
+	var unhandled []Command
+	n.SetUnhandledCommandHandler(func(command Command) {
+		unhandled = append(unhandled, command)
+	})
+	n.DispatchCommand("nobody")
+	n.AddCommandListenerForSources(commandFunc(func(Command) {}), "user")
+	user := testCommand{source: "user"}
+	rule := testCommand{source: "rule"}
+	n.DispatchCommand(user)
+	n.DispatchCommand(rule)
+	if !reflect.DeepEqual(unhandled, []Command{"nobody", rule}) {
+		t.Fatalf("Expected only commands accepted by no listener to be unhandled, got %v", unhandled)
+	}
+	n.SetUnhandledCommandHandler(nil)
+	n.DispatchCommand(rule)
+	if len(unhandled) != 2 {
+		t.Fatalf("Expected no unhandled commands after removing the handler, got %v", unhandled)
+	}
+}
@@ -1,5 +1,67 @@
 package zigbee
 
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode identifies the category of a zigbee error.
+type ErrorCode int
+
+const (
+	// CodeUnknown is the code of errors without a category, and of errors not generated by this package.
+	CodeUnknown ErrorCode = iota
+	// CodeInvalid is the code of errors caused by malformed addresses, devices or groups.
+	CodeInvalid
+	// CodeConflict is the code of errors caused by labels or addresses already in use.
+	CodeConflict
+	// CodeCapacity is the code of errors caused by a network having reached its maximum number of devices.
+	CodeCapacity
+	// CodeFrozen is the code of errors caused by mutations of a frozen network.
+	CodeFrozen
+	// CodeNotFound is the code of errors caused by missing state files or commands.
+	CodeNotFound
+	// CodeIO is the code of errors caused by reading or writing state.
+	CodeIO
+	// CodeEncoding is the code of errors caused by marshaling, unmarshaling or compressing state.
+	CodeEncoding
+	// CodeTimeout is the code of errors caused by responses not received in time.
+	CodeTimeout
+	// CodeDisabled is the code of errors caused by commands addressed to disabled devices.
+	CodeDisabled
+	// CodeIntegrity is the code of the problems reported by CheckIntegrity.
+	CodeIntegrity
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeUnknown:
+		return "Unknown"
+	case CodeInvalid:
+		return "Invalid"
+	case CodeConflict:
+		return "Conflict"
+	case CodeCapacity:
+		return "Capacity"
+	case CodeFrozen:
+		return "Frozen"
+	case CodeNotFound:
+		return "NotFound"
+	case CodeIO:
+		return "IO"
+	case CodeEncoding:
+		return "Encoding"
+	case CodeTimeout:
+		return "Timeout"
+	case CodeDisabled:
+		return "Disabled"
+	case CodeIntegrity:
+		return "Integrity"
+	default:
+		return fmt.Sprintf("ErrorCode(%d)", int(c))
+	}
+}
+
 // NewError will create a new zigbee error.
 func NewError(message string) error {
 	return &customError{message: message}
@@ -10,13 +72,46 @@ func NewErrorWithCause(message string, cause error) error {
 	return &customError{message: message, cause: cause}
 }
 
+// newCodedError will create a new zigbee error with supplied code.
+func newCodedError(code ErrorCode, message string) error {
+	return &customError{code: code, message: message}
+}
+
+// newCodedErrorWithCause will create a new zigbee error with supplied code and cause.
+func newCodedErrorWithCause(code ErrorCode, message string, cause error) error {
+	return &customError{code: code, message: message, cause: cause}
+}
+
+// wrapError will create a new zigbee error with supplied code, wrapping cause. As with errors.Wrap, the message of
+// the cause is appended to the supplied message.
+func wrapError(code ErrorCode, cause error, message string) error {
+	return &customError{code: code, message: message + ": " + cause.Error(), cause: cause}
+}
+
 // IsError check if the supplied error is a zigbee error.
 func IsError(err error) bool {
 	_, ok := err.(*customError)
 	return ok
 }
 
+// CodeOf returns the code of the supplied error, unwrapping it until a zigbee error with a code is found. Errors are
+// unwrapped following both their Cause and Unwrap methods. CodeUnknown is returned if no such error is found.
+func CodeOf(err error) ErrorCode {
+	for err != nil {
+		if e, ok := err.(*customError); ok && e.code != CodeUnknown {
+			return e.code
+		}
+		if causer, ok := err.(interface{ Cause() error }); ok {
+			err = causer.Cause()
+			continue
+		}
+		err = errors.Unwrap(err)
+	}
+	return CodeUnknown
+}
+
 type customError struct {
+	code    ErrorCode
 	message string
 	cause   error
 }
@@ -24,3 +119,13 @@ type customError struct {
 func (e *customError) Error() string {
 	return e.message
 }
+
+// Code returns the code of the error.
+func (e *customError) Code() ErrorCode {
+	return e.code
+}
+
+// Unwrap returns the cause of the error, if any, so that the error can be inspected with errors.Is and errors.As.
+func (e *customError) Unwrap() error {
+	return e.cause
+}
@@ -0,0 +1,71 @@
+package zigbee
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+func TestErrorCodes(t *testing.T) {
+	n := NewNetworkState(true, WithClusterValidation(OnOffCluster))
+	n.AddDevice(testDevice(1, 1))
+	n.SetDeviceEnabled(1, false)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, timeout := n.DispatchWithResponse(ctx, "ping")
+	_, disabled := n.DispatchWithResponse(context.Background(), testCommand{destination: NewDeviceAddress(1, 1)})
+	full := NewNetworkState(true, WithMaxDevices(1))
+	full.AddDevice(testDevice(1, 1))
+	frozen := NewNetworkState(true)
+	frozen.Freeze()
+	for _, test := range []struct {
+		err  error
+		code ErrorCode
+	}{
+		{n.AddDeviceChecked(Device{IEEEAddress: 2, NetworkAddress: NewDeviceAddress(2, 1)}), CodeInvalid},
+		{n.AddDeviceChecked(testDevice(1, 2)), CodeConflict},
+		{full.AddDeviceChecked(testDevice(3, 3)), CodeCapacity},
+		{frozen.AddDeviceChecked(testDevice(1, 1)), CodeFrozen},
+		{n.SubmitResponse(42, "pong"), CodeNotFound},
+		{n.ReadState(failingReader{}), CodeIO},
+		{n.ReadState(strings.NewReader("{corrupted")), CodeEncoding},
+		{timeout, CodeTimeout},
+		{disabled, CodeDisabled},
+		{pkgerrors.Wrap(newCodedError(CodeIO, "wrapped"), "outer"), CodeIO},
+		{NewErrorWithCause("outer", newCodedError(CodeConflict, "inner")), CodeConflict},
+		{fmt.Errorf("outer: %w", newCodedError(CodeTimeout, "inner")), CodeTimeout},
+		{NewErrorWithCause("outer", fmt.Errorf("middle: %w", newCodedError(CodeNotFound, "inner"))), CodeNotFound},
+		{NewError("uncoded"), CodeUnknown},
+		{errors.New("foreign"), CodeUnknown},
+		{nil, CodeUnknown},
+	} {
+		if code := CodeOf(test.err); code != test.code {
+			t.Errorf("Expected error %v to have code %s, got %s", test.err, test.code, code)
+		}
+	}
+	if s := ErrorCode(99).String(); s != "ErrorCode(99)" {
+		t.Fatalf("Expected unknown codes to be formatted with their value, got %s", s)
+	}
+}
+
+func TestErrorUnwrap(t *testing.T) {
+	cause := errors.New("cause")
+	err := fmt.Errorf("context: %w", wrapError(CodeIO, cause, "Unable to read"))
+	if !errors.Is(err, cause) {
+		t.Fatalf("Expected %v to wrap its cause", err)
+	}
+	var coded interface{ Code() ErrorCode }
+	if !errors.As(err, &coded) || coded.Code() != CodeIO {
+		t.Fatalf("Expected %v to wrap a coded error", err)
+	}
+}
+
+// failingReader is a reader always failing.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("read failure") }
@@ -0,0 +1,41 @@
+package zigbee
+
+import (
+	"log"
+	"time"
+)
+
+// sweepStaleDevices will periodically remove the devices not seen within the configured maximum age, until the
+// eviction is stopped.
+func (n *Network) sweepStaleDevices() {
+	ticker := time.NewTicker(n.evictionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.evictionDone:
+			return
+		case now := <-ticker.C:
+			if evicted := n.evictDevicesNotSeenSince(now.Add(-n.evictionMaxAge)); evicted > 0 {
+				log.Printf("Evicted %d stale devices.", evicted)
+			}
+		}
+	}
+}
+
+// evictDevicesNotSeenSince will remove the devices last seen before the supplied time, returning the number of
+// removed devices. Devices never seen are kept.
+func (n *Network) evictDevicesNotSeenSince(t time.Time) int {
+	return n.RemoveDevicesWhere(func(device Device) bool {
+		return !device.LastSeen.IsZero() && device.LastSeen.Before(t)
+	})
+}
+
+// stopEviction will stop the stale devices sweeper, if any.
+func (n *Network) stopEviction() {
+	if n.evictionDone == nil {
+		return
+	}
+	n.evictionOnce.Do(func() {
+		close(n.evictionDone)
+	})
+}
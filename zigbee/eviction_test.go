@@ -0,0 +1,35 @@
+package zigbee
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStaleEviction(t *testing.T) {
+	n := newTestNetwork(t, WithStaleEviction(time.Minute, 10*time.Millisecond))
+	stale := testDevice(1, 1)
+	stale.LastSeen = time.Now().Add(-time.Hour)
+	n.AddDevice(stale)
+	n.AddDevice(testDevice(2, 2))
+	n.Touch(2)
+	n.AddDevice(testDevice(3, 3))
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(listener.Events()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the stale device to be evicted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := n.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if events := listener.Events(); !reflect.DeepEqual(events, []string{"removed 1/1"}) {
+		t.Fatalf("Expected only the stale device to be evicted, got %v", events)
+	}
+	if addresses := networkAddresses(n.Devices()); !reflect.DeepEqual(addresses, []uint32{2, 3}) {
+		t.Fatalf("Expected recently seen and never seen devices to be kept, got %v", addresses)
+	}
+}
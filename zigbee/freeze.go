@@ -0,0 +1,35 @@
+package zigbee
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// ErrNetworkFrozen is returned by checked mutations while the network is frozen.
+var ErrNetworkFrozen = newCodedError(CodeFrozen, "Network is frozen")
+
+// Freeze will make the network read-only until Unfreeze is called. While frozen, checked mutations return
+// ErrNetworkFrozen and the other ones are logged and discarded. Reads are still allowed.
+func (n *Network) Freeze() {
+	atomic.StoreUint32(&n.frozen, 1)
+}
+
+// Unfreeze will allow again the mutations of a frozen network.
+func (n *Network) Unfreeze() {
+	atomic.StoreUint32(&n.frozen, 0)
+}
+
+// Frozen returns true if the network is frozen.
+func (n *Network) Frozen() bool {
+	return atomic.LoadUint32(&n.frozen) == 1
+}
+
+// rejectFrozen will log a warning and return true if the supplied operation must be discarded because the network
+// is frozen.
+func (n *Network) rejectFrozen(operation string) bool {
+	if !n.Frozen() {
+		return false
+	}
+	log.Printf("Discarding %s: %v", operation, ErrNetworkFrozen)
+	return true
+}
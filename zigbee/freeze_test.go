@@ -0,0 +1,36 @@
+package zigbee
+
+import (
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	n.AddGroupListener(listener)
+	n.Freeze()
+	if !n.Frozen() {
+		t.Fatal("Expected the network to be frozen")
+	}
+	if err := n.AddDeviceChecked(testDevice(4, 4)); err != ErrNetworkFrozen {
+		t.Fatalf("Expected checked mutations to be rejected, got %v", err)
+	}
+	n.AddDevice(testDevice(5, 5))
+	n.RemoveDeviceByIEEE(1)
+	n.SetDeviceLabel(2, "lamp")
+	n.AddGroup(GroupAddress{GroupID: 3, Label: "office"})
+	n.RemoveGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroupMember(2, 1)
+	if events := listener.Events(); len(events) != 0 {
+		t.Fatalf("Expected no changes while frozen, got %v", events)
+	}
+	if len(n.Devices()) != 3 || len(n.Groups()) != 2 || len(n.GroupMembers(2)) != 1 {
+		t.Fatalf("Expected a frozen network to be unchanged and readable, got %v", n)
+	}
+	n.Unfreeze()
+	if err := n.AddDeviceChecked(testDevice(4, 4)); err != nil || n.Frozen() {
+		t.Fatalf("Expected mutations to be allowed after unfreezing, got %v", err)
+	}
+}
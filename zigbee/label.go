@@ -0,0 +1,49 @@
+package zigbee
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// LabelPolicy defines how device and group labels that are not valid UTF-8 are handled.
+type LabelPolicy int
+
+const (
+	// ReplaceInvalidLabels replaces each invalid UTF-8 byte of labels with U+FFFD. It's the default policy.
+	ReplaceInvalidLabels LabelPolicy = iota
+	// RejectInvalidLabels rejects devices and groups whose label is not valid UTF-8. Checked mutations return an
+	// error, the other ones are logged and discarded.
+	RejectInvalidLabels
+)
+
+// sanitizeLabel will apply the configured label policy to the supplied label.
+func (n *Network) sanitizeLabel(label string) (string, error) {
+	if utf8.ValidString(label) {
+		return label, nil
+	}
+	if n.labelPolicy == RejectInvalidLabels {
+		return label, newCodedError(CodeInvalid, fmt.Sprintf("Label %q is not valid UTF-8", label))
+	}
+	// Converting to runes replaces each invalid byte with utf8.RuneError
+	return string([]rune(label)), nil
+}
+
+// sanitizeDevice will apply the configured label policy to the device label.
+func (n *Network) sanitizeDevice(device Device) (Device, error) {
+	label, err := n.sanitizeLabel(device.Label)
+	if err != nil {
+		return device, err
+	}
+	device.Label = label
+	return device, nil
+}
+
+// sanitizeGroup will apply the configured label policy to the group label.
+func (n *Network) sanitizeGroup(group GroupAddress) (GroupAddress, error) {
+	label, err := n.sanitizeLabel(group.Label)
+	if err != nil {
+		return group, err
+	}
+	group.Label = label
+	return group, nil
+}
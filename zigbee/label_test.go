@@ -0,0 +1,37 @@
+package zigbee
+
+import (
+	"testing"
+)
+
+func TestLabelPolicies(t *testing.T) {
+	invalid := "caf\xe9"
+	replace := NewNetworkState(true)
+	device := testDevice(1, 1)
+	device.Label = invalid
+	if err := replace.AddDeviceChecked(device); err != nil {
+		t.Fatal(err)
+	}
+	replace.AddGroup(GroupAddress{GroupID: 1, Label: invalid})
+	if stored, _ := replace.Device(device.NetworkAddress); stored.Label != "caf�" {
+		t.Fatalf("Expected invalid bytes to be replaced, got %q", stored.Label)
+	}
+	if groups := replace.Groups(); len(groups) != 1 || groups[0].Label != "caf�" {
+		t.Fatalf("Expected invalid group label bytes to be replaced, got %v", groups)
+	}
+	reject := NewNetworkState(true, WithLabelPolicy(RejectInvalidLabels))
+	if err := reject.AddDeviceChecked(device); CodeOf(err) != CodeInvalid {
+		t.Fatalf("Expected invalid labels to be rejected, got %v", err)
+	}
+	reject.AddGroup(GroupAddress{GroupID: 1, Label: invalid})
+	if len(reject.Devices()) != 0 || len(reject.Groups()) != 0 {
+		t.Fatalf("Expected nothing to be added, got %v", reject)
+	}
+	device.Label = "café ☕"
+	if err := reject.AddDeviceChecked(device); err != nil {
+		t.Fatalf("Expected valid UTF-8 labels to be accepted, got %v", err)
+	}
+	if stored, _ := reject.Device(device.NetworkAddress); stored.Label != "café ☕" {
+		t.Fatalf("Expected valid labels to be unchanged, got %q", stored.Label)
+	}
+}
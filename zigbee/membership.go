@@ -0,0 +1,511 @@
+package zigbee
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// watchBufferSize is the capacity of the channels returned by WatchGroup.
+const watchBufferSize = 64
+
+// MembershipListener is the interface implemented by group listeners who needs to be
+// notified by group membership changes.
+type MembershipListener interface {
+	GroupMemberAdded(GroupAddress, uint64)
+	GroupMemberRemoved(GroupAddress, uint64)
+}
+
+// GroupChangeKind identifies the kind of a group change.
+type GroupChangeKind int
+
+const (
+	// GroupMemberAdded means a device has been added to the group.
+	GroupMemberAdded GroupChangeKind = iota
+	// GroupMemberRemoved means a device has been removed from the group.
+	GroupMemberRemoved
+	// GroupRenamed means the group label has changed.
+	GroupRenamed
+	// GroupDeleted means the group has been removed from the network.
+	GroupDeleted
+)
+
+func (k GroupChangeKind) String() string {
+	switch k {
+	case GroupMemberAdded:
+		return "GroupMemberAdded"
+	case GroupMemberRemoved:
+		return "GroupMemberRemoved"
+	case GroupRenamed:
+		return "GroupRenamed"
+	case GroupDeleted:
+		return "GroupDeleted"
+	default:
+		return "Unknown"
+	}
+}
+
+// GroupChange describes a change of a watched group. Member is the IEEE address of the added or removed device.
+type GroupChange struct {
+	Kind   GroupChangeKind
+	Group  GroupAddress
+	Member uint64
+}
+
+// GroupMembership is the serializable representation of the members of a group.
+type GroupMembership struct {
+	GroupID uint32   `json:"groupId"`
+	Scope   uint32   `json:"scope,omitempty"`
+	Members []uint64 `json:"members"`
+}
+
+// MarshalJSON will implement custom JSON serialization, with members IEEE addresses serialized as hex strings.
+func (m GroupMembership) MarshalJSON() ([]byte, error) {
+	type serializedMembership GroupMembership
+	state := struct {
+		serializedMembership
+		Members []ieeeAddressJSON `json:"members"`
+	}{serializedMembership: serializedMembership(m), Members: make([]ieeeAddressJSON, len(m.Members))}
+	for i, member := range m.Members {
+		state.Members[i] = ieeeAddressJSON(member)
+	}
+	return json.Marshal(state)
+}
+
+// UnmarshalJSON will implement custom JSON deserialization. Members IEEE addresses are accepted both as hex strings
+// and as numbers.
+func (m *GroupMembership) UnmarshalJSON(data []byte) error {
+	type serializedMembership GroupMembership
+	state := struct {
+		*serializedMembership
+		Members []ieeeAddressJSON `json:"members"`
+	}{serializedMembership: (*serializedMembership)(m)}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	m.Members = make([]uint64, len(state.Members))
+	for i, member := range state.Members {
+		m.Members[i] = uint64(member)
+	}
+	return nil
+}
+
+// DeviceWithGroups pairs a device with the groups it's member of.
+type DeviceWithGroups struct {
+	Device Device
+	Groups []GroupAddress
+}
+
+// AddGroupMember will add the device with supplied IEEE address to the group with supplied id in the default scope.
+// The bool value is false if the group was not found.
+func (n *Network) AddGroupMember(groupID uint32, ieee uint64) bool {
+	return n.AddScopedGroupMember(0, groupID, ieee)
+}
+
+// AddScopedGroupMember will add the device with supplied IEEE address to the group with supplied scope and id. The
+// bool value is false if the group was not found.
+func (n *Network) AddScopedGroupMember(scope, groupID uint32, ieee uint64) bool {
+	if n.rejectFrozen("group member add") {
+		return false
+	}
+	n.groupsMx.Lock()
+	defer n.unlockGroups()
+	group, ok := n.groups[groupKey{scope: scope, groupID: groupID}]
+	if !ok {
+		return false
+	}
+	n.addMember(group, ieee)
+	return true
+}
+
+// RemoveGroupMember will remove the device with supplied IEEE address from the group with supplied id in the default
+// scope. The bool value is false if the device was not a member of the group.
+func (n *Network) RemoveGroupMember(groupID uint32, ieee uint64) bool {
+	return n.RemoveScopedGroupMember(0, groupID, ieee)
+}
+
+// RemoveScopedGroupMember will remove the device with supplied IEEE address from the group with supplied scope and
+// id. The bool value is false if the device was not a member of the group.
+func (n *Network) RemoveScopedGroupMember(scope, groupID uint32, ieee uint64) bool {
+	if n.rejectFrozen("group member removal") {
+		return false
+	}
+	n.groupsMx.Lock()
+	defer n.unlockGroups()
+	group, ok := n.groups[groupKey{scope: scope, groupID: groupID}]
+	if !ok || !n.memberships[group.key()][ieee] {
+		return false
+	}
+	n.removeMember(group, ieee)
+	return true
+}
+
+// SetGroupMembers will replace the members of the group with supplied id in the default scope with the supplied IEEE
+// addresses in a single operation. Membership events are fired only for the devices actually added or removed, so
+// calling it again with the same members has no effect. Unknown groups are ignored.
+func (n *Network) SetGroupMembers(groupID uint32, ieees []uint64) {
+	n.SetScopedGroupMembers(0, groupID, ieees)
+}
+
+// SetScopedGroupMembers will replace the members of the group with supplied scope and id with the supplied IEEE
+// addresses, as done by SetGroupMembers.
+func (n *Network) SetScopedGroupMembers(scope, groupID uint32, ieees []uint64) {
+	if n.rejectFrozen("group members replacement") {
+		return
+	}
+	n.groupsMx.Lock()
+	defer n.unlockGroups()
+	group, ok := n.groups[groupKey{scope: scope, groupID: groupID}]
+	if !ok {
+		return
+	}
+	toAdd, toRemove := membershipDiff(n.memberships[group.key()], ieees)
+	for _, ieee := range toRemove {
+		n.removeMember(group, ieee)
+	}
+	for _, ieee := range toAdd {
+		n.addMember(group, ieee)
+	}
+}
+
+// GroupMembershipDiff returns the sorted IEEE addresses to add to and to remove from the group with supplied id so
+// that its members match the desired ones, without changing the group. An unknown group has no members.
+func (n *Network) GroupMembershipDiff(groupID uint32, desired []uint64) (toAdd, toRemove []uint64) {
+	n.groupsMx.RLock()
+	defer n.groupsMx.RUnlock()
+	return membershipDiff(n.memberships[groupKey{groupID: groupID}], desired)
+}
+
+// GroupMembers returns the sorted IEEE addresses of the members of the group with supplied id in the default scope.
+func (n *Network) GroupMembers(groupID uint32) []uint64 {
+	return n.ScopedGroupMembers(0, groupID)
+}
+
+// ScopedGroupMembers returns the sorted IEEE addresses of the members of the group with supplied scope and id.
+func (n *Network) ScopedGroupMembers(scope, groupID uint32) []uint64 {
+	n.groupsMx.RLock()
+	defer n.groupsMx.RUnlock()
+	return sortedMembers(n.memberships[groupKey{scope: scope, groupID: groupID}])
+}
+
+// GroupsForDevice returns the groups the device with supplied IEEE address is member of, sorted by group id.
+func (n *Network) GroupsForDevice(ieee uint64) []GroupAddress {
+	n.groupsMx.RLock()
+	defer n.groupsMx.RUnlock()
+	var result []GroupAddress
+	for key, members := range n.memberships {
+		if group, ok := n.groups[key]; ok && members[ieee] {
+			result = append(result, group)
+		}
+	}
+	sortGroups(result)
+	return result
+}
+
+// DevicesWithGroups returns all the devices, sorted by network address, each one with the groups it's member of.
+func (n *Network) DevicesWithGroups() []DeviceWithGroups {
+	var result []DeviceWithGroups
+	n.withReadLocks(func() {
+		groupsByMember := make(map[uint64][]GroupAddress)
+		for key, members := range n.memberships {
+			group, ok := n.groups[key]
+			if !ok {
+				continue
+			}
+			for ieee := range members {
+				groupsByMember[ieee] = append(groupsByMember[ieee], group)
+			}
+		}
+		for _, groups := range groupsByMember {
+			sortGroups(groups)
+		}
+		for _, device := range n.devices {
+			result = append(result, DeviceWithGroups{Device: device, Groups: groupsByMember[device.IEEEAddress]})
+		}
+	})
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Device.NetworkAddress.Less(result[j].Device.NetworkAddress)
+	})
+	return result
+}
+
+// ReplayGroups will notify the listener synchronously of every group already in the network as added and, if it's a
+// MembershipListener, of each of their members. It's the counterpart of AddNetworkListenerWithReplay for groups, and
+// can be used after Startup to learn about the loaded groups and memberships. Groups and memberships are copied
+// before the replay, so the listener can read and change the network.
+func (n *Network) ReplayGroups(listener GroupListener) {
+	if listener == nil {
+		return
+	}
+	var groups []GroupAddress
+	members := make(map[groupKey][]uint64)
+	n.groupsMx.RLock()
+	for key, group := range n.groups {
+		groups = append(groups, group)
+		members[key] = sortedMembers(n.memberships[key])
+	}
+	n.groupsMx.RUnlock()
+	sortGroups(groups)
+	membershipListener, _ := listener.(MembershipListener)
+	for _, group := range groups {
+		listener.GroupAdded(group)
+		if membershipListener == nil {
+			continue
+		}
+		for _, ieee := range members[group.key()] {
+			membershipListener.GroupMemberAdded(group, ieee)
+		}
+	}
+}
+
+// WatchGroup returns a channel receiving the changes of the group with supplied id in the default scope. The channel
+// is closed when the group is removed, and it's returned already closed if the group does not exist. Changes are
+// dropped if the channel buffer is full.
+func (n *Network) WatchGroup(groupID uint32) <-chan GroupChange {
+	return n.WatchScopedGroup(0, groupID)
+}
+
+// WatchScopedGroup returns a channel receiving the changes of the group with supplied scope and id, as done by
+// WatchGroup.
+func (n *Network) WatchScopedGroup(scope, groupID uint32) <-chan GroupChange {
+	n.groupsMx.Lock()
+	defer n.groupsMx.Unlock()
+	changes := make(chan GroupChange, watchBufferSize)
+	key := groupKey{scope: scope, groupID: groupID}
+	if _, ok := n.groups[key]; !ok {
+		close(changes)
+		return changes
+	}
+	if n.watchers == nil {
+		n.watchers = make(map[groupKey][]chan GroupChange)
+	}
+	n.watchers[key] = append(n.watchers[key], changes)
+	return changes
+}
+
+// OrphanedMemberships returns, for each group id, the sorted IEEE addresses of members with no device in the network.
+func (n *Network) OrphanedMemberships() map[uint32][]uint64 {
+	result := make(map[uint32][]uint64)
+	n.withReadLocks(func() {
+		for key, orphans := range n.orphanedMemberships() {
+			result[key.groupID] = append(result[key.groupID], orphans...)
+		}
+	})
+	for groupID, orphans := range result {
+		sort.Slice(orphans, func(i, j int) bool { return orphans[i] < orphans[j] })
+		result[groupID] = orphans
+	}
+	return result
+}
+
+// PruneOrphanedMemberships will remove the group members with no device in the network, returning the number of
+// removed memberships.
+func (n *Network) PruneOrphanedMemberships() int {
+	if n.rejectFrozen("orphaned memberships pruning") {
+		return 0
+	}
+	count := 0
+	n.withWriteLocks(func() {
+		for key, orphans := range n.orphanedMemberships() {
+			for _, ieee := range orphans {
+				n.removeMember(n.groups[key], ieee)
+				count++
+			}
+		}
+	})
+	return count
+}
+
+// orphanedMemberships returns the members of each group with no device in the network. Caller must hold the devices
+// and groups locks.
+func (n *Network) orphanedMemberships() map[groupKey][]uint64 {
+	ieees := make(map[uint64]bool, len(n.devices))
+	for _, device := range n.devices {
+		ieees[device.IEEEAddress] = true
+	}
+	result := make(map[groupKey][]uint64)
+	for key, members := range n.memberships {
+		for _, ieee := range sortedMembers(members) {
+			if !ieees[ieee] {
+				result[key] = append(result[key], ieee)
+			}
+		}
+	}
+	return result
+}
+
+// addMember will add the member to the group. Caller must hold the groups write lock.
+func (n *Network) addMember(group GroupAddress, ieee uint64) {
+	key := group.key()
+	if n.memberships == nil {
+		n.memberships = make(map[groupKey]map[uint64]bool)
+	}
+	if n.memberships[key] == nil {
+		n.memberships[key] = make(map[uint64]bool)
+	}
+	if n.memberships[key][ieee] {
+		return
+	}
+	n.memberships[key][ieee] = true
+	n.markDirty()
+	n.logMember(walAddMember, group, ieee)
+	n.publishGroupChange(GroupChange{Kind: GroupMemberAdded, Group: group, Member: ieee})
+	n.queueGroupListeners(func(listener GroupListener) {
+		if listener, ok := listener.(MembershipListener); ok {
+			listener.GroupMemberAdded(group, ieee)
+		}
+	})
+}
+
+// removeMember will remove the member from the group. Caller must hold the groups write lock.
+func (n *Network) removeMember(group GroupAddress, ieee uint64) {
+	key := group.key()
+	if !n.memberships[key][ieee] {
+		return
+	}
+	delete(n.memberships[key], ieee)
+	if len(n.memberships[key]) == 0 {
+		delete(n.memberships, key)
+	}
+	n.markDirty()
+	n.logMember(walRemoveMember, group, ieee)
+	n.publishGroupChange(GroupChange{Kind: GroupMemberRemoved, Group: group, Member: ieee})
+	n.queueGroupListeners(func(listener GroupListener) {
+		if listener, ok := listener.(MembershipListener); ok {
+			listener.GroupMemberRemoved(group, ieee)
+		}
+	})
+}
+
+// removeMemberships will remove the device with supplied IEEE address from all groups, unless another device with
+// the same IEEE address is still in the network. Caller must hold the devices write lock.
+func (n *Network) removeMemberships(ieee uint64) {
+	if _, ok := n.deviceKeyByIEEE(ieee); ok {
+		return
+	}
+	n.groupsMx.Lock()
+	defer n.unlockNestedGroups()
+	n.removeMembershipsLocked(ieee)
+}
+
+// removeMembershipsLocked will remove the device with supplied IEEE address from all groups. Caller must hold the
+// devices lock and the groups write lock.
+func (n *Network) removeMembershipsLocked(ieee uint64) {
+	if _, ok := n.deviceKeyByIEEE(ieee); ok {
+		return
+	}
+	for key, members := range n.memberships {
+		if members[ieee] {
+			n.removeMember(n.groups[key], ieee)
+		}
+	}
+}
+
+// replaceMemberships will replace all group memberships with the supplied ones, adding and removing members as
+// needed. Memberships of unknown groups are ignored. Caller must hold the groups write lock.
+func (n *Network) replaceMemberships(memberships []GroupMembership) {
+	replacement := make(map[groupKey]map[uint64]bool)
+	for _, membership := range memberships {
+		key := groupKey{scope: membership.Scope, groupID: membership.GroupID}
+		if _, ok := n.groups[key]; !ok {
+			continue
+		}
+		if replacement[key] == nil {
+			replacement[key] = make(map[uint64]bool)
+		}
+		for _, ieee := range membership.Members {
+			replacement[key][ieee] = true
+		}
+	}
+	for key, members := range n.memberships {
+		group, ok := n.groups[key]
+		if !ok {
+			group = GroupAddress{GroupID: key.groupID, Scope: key.scope}
+		}
+		for ieee := range members {
+			if !replacement[key][ieee] {
+				n.removeMember(group, ieee)
+			}
+		}
+	}
+	for key, members := range replacement {
+		for ieee := range members {
+			n.addMember(n.groups[key], ieee)
+		}
+	}
+}
+
+// groupUpdated will publish the rename of the group to its watchers. Caller must hold the groups write lock.
+func (n *Network) groupUpdated(previous, current GroupAddress) {
+	if previous.Label != current.Label {
+		n.publishGroupChange(GroupChange{Kind: GroupRenamed, Group: current})
+	}
+}
+
+// groupRemoved will drop the group memberships and close its watchers. Caller must hold the groups write lock.
+func (n *Network) groupRemoved(group GroupAddress) {
+	key := group.key()
+	if _, ok := n.memberships[key]; ok {
+		delete(n.memberships, key)
+		n.markDirty()
+	}
+	n.publishGroupChange(GroupChange{Kind: GroupDeleted, Group: group})
+	for _, changes := range n.watchers[key] {
+		close(changes)
+	}
+	delete(n.watchers, key)
+}
+
+// publishGroupChange will send the change to the group watchers. Caller must hold the groups write lock.
+func (n *Network) publishGroupChange(change GroupChange) {
+	for _, changes := range n.watchers[change.Group.key()] {
+		select {
+		case changes <- change:
+		default:
+		}
+	}
+}
+
+// serializedMemberships returns the serializable representation of group memberships. Caller must hold the groups lock.
+func (n *Network) serializedMemberships() []GroupMembership {
+	var result []GroupMembership
+	for key, members := range n.memberships {
+		result = append(result, GroupMembership{GroupID: key.groupID, Scope: key.scope, Members: sortedMembers(members)})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].GroupID != result[j].GroupID {
+			return result[i].GroupID < result[j].GroupID
+		}
+		return result[i].Scope < result[j].Scope
+	})
+	return result
+}
+
+// membershipDiff returns the sorted IEEE addresses in desired but not in current, and in current but not in desired.
+func membershipDiff(current map[uint64]bool, desired []uint64) (toAdd, toRemove []uint64) {
+	wanted := make(map[uint64]bool, len(desired))
+	for _, ieee := range desired {
+		wanted[ieee] = true
+	}
+	added := make(map[uint64]bool)
+	for ieee := range wanted {
+		if !current[ieee] {
+			added[ieee] = true
+		}
+	}
+	removed := make(map[uint64]bool)
+	for ieee := range current {
+		if !wanted[ieee] {
+			removed[ieee] = true
+		}
+	}
+	return sortedMembers(added), sortedMembers(removed)
+}
+
+func sortedMembers(members map[uint64]bool) []uint64 {
+	var result []uint64
+	for ieee := range members {
+		result = append(result, ieee)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
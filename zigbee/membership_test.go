@@ -0,0 +1,262 @@
+package zigbee
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWatchGroup(t *testing.T) {
+	n := NewNetworkState(true)
+	if _, ok := <-n.WatchGroup(1); ok {
+		t.Fatal("Expected the channel of an unknown group to be closed")
+	}
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroup(GroupAddress{GroupID: 2, Label: "garden"})
+	changes := n.WatchGroup(1)
+	n.AddGroupMember(1, 0x10)
+	n.AddGroupMember(2, 0x20)
+	n.RemoveGroupMember(1, 0x10)
+	n.UpdateGroup(GroupAddress{GroupID: 1, Label: "dining"})
+	n.RemoveGroup(GroupAddress{GroupID: 1, Label: "dining"})
+	expected := []GroupChange{
+		{Kind: GroupMemberAdded, Member: 0x10},
+		{Kind: GroupMemberRemoved, Member: 0x10},
+		{Kind: GroupRenamed},
+		{Kind: GroupDeleted},
+	}
+	var received []GroupChange
+	for change := range changes {
+		received = append(received, change)
+	}
+	if len(received) != len(expected) {
+		t.Fatalf("Expected %d changes before the channel is closed, got %v", len(expected), received)
+	}
+	for i, change := range received {
+		if change.Kind != expected[i].Kind || change.Member != expected[i].Member || change.Group.GroupID != 1 {
+			t.Fatalf("Expected change %d to be %v of group 1, got %v", i, expected[i], change)
+		}
+	}
+	if received[2].Group.Label != "dining" {
+		t.Fatalf("Expected the renamed group to be reported, got %v", received[2].Group)
+	}
+}
+
+func TestOrphanedMemberships(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddDevice(testDevice(1, 1))
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroup(GroupAddress{GroupID: 2, Label: "garden"})
+	n.AddGroupMember(1, 1)
+	n.AddGroupMember(1, 3)
+	n.AddGroupMember(1, 2)
+	n.AddGroupMember(2, 1)
+	expected := map[uint32][]uint64{1: {2, 3}}
+	if orphans := n.OrphanedMemberships(); !reflect.DeepEqual(orphans, expected) {
+		t.Fatalf("Expected orphaned memberships %v, got %v", expected, orphans)
+	}
+	listener := &recordingListener{}
+	n.AddGroupListener(listener)
+	if count := n.PruneOrphanedMemberships(); count != 2 {
+		t.Fatalf("Expected 2 memberships to be pruned, got %d", count)
+	}
+	if events := listener.Events(); !reflect.DeepEqual(events, []string{"member removed 1 2", "member removed 1 3"}) {
+		t.Fatalf("Expected pruned members to be notified, got %v", events)
+	}
+	if orphans := n.OrphanedMemberships(); len(orphans) != 0 {
+		t.Fatalf("Expected no orphaned memberships after pruning, got %v", orphans)
+	}
+	if members := n.GroupMembers(1); !reflect.DeepEqual(members, []uint64{1}) {
+		t.Fatalf("Expected members with a device to be kept, got %v", members)
+	}
+}
+
+func TestDevicesWithGroups(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	n.AddGroupMember(2, 1)
+	result := n.DevicesWithGroups()
+	if len(result) != 3 {
+		t.Fatalf("Expected 3 devices, got %v", result)
+	}
+	expected := [][]uint32{{1, 2}, {1}, {2}}
+	for i, device := range result {
+		if device.Device.NetworkAddress != NewDeviceAddress(uint32(i+1), 1) {
+			t.Fatalf("Expected devices sorted by network address, got %v", result)
+		}
+		var groupIDs []uint32
+		for _, group := range device.Groups {
+			groupIDs = append(groupIDs, group.GroupID)
+		}
+		if !reflect.DeepEqual(groupIDs, expected[i]) {
+			t.Errorf("Expected device %s to be member of groups %v, got %v", device.Device.NetworkAddress, expected[i], groupIDs)
+		}
+	}
+}
+
+func TestGroupsForDevice(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	n.AddGroup(GroupAddress{GroupID: 3, Label: "office"})
+	n.AddGroupMember(3, 1)
+	for _, test := range []struct {
+		ieee   uint64
+		groups []uint32
+	}{
+		{4, nil},
+		{2, []uint32{1}},
+		{1, []uint32{1, 3}},
+	} {
+		var groupIDs []uint32
+		for _, group := range n.GroupsForDevice(test.ieee) {
+			groupIDs = append(groupIDs, group.GroupID)
+		}
+		if !reflect.DeepEqual(groupIDs, test.groups) {
+			t.Errorf("Expected device %x to be member of groups %v, got %v", test.ieee, test.groups, groupIDs)
+		}
+	}
+}
+
+func TestReplayGroupsOfLoadedState(t *testing.T) {
+	n := newTestNetwork(t)
+	populateNetwork(n)
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := loadNetwork(t, n.filePath)
+	listener := &recordingListener{}
+	loaded.ReplayGroups(listener)
+	expected := []string{"group added 1", "member added 1 1", "member added 1 2", "group added 2", "member added 2 3"}
+	if events := listener.Events(); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected replayed events %v, got %v", expected, events)
+	}
+}
+
+func TestSetGroupMembers(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	listener := &recordingListener{}
+	n.AddGroupListener(listener)
+	n.SetGroupMembers(1, []uint64{2, 3, 4})
+	expected := []string{"member removed 1 1", "member added 1 3", "member added 1 4"}
+	if events := listener.Events(); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+	if members := n.GroupMembers(1); !reflect.DeepEqual(members, []uint64{2, 3, 4}) {
+		t.Fatalf("Expected members to be replaced, got %v", members)
+	}
+	n.SetGroupMembers(1, []uint64{4, 3, 2})
+	n.SetGroupMembers(5, []uint64{1})
+	if events := listener.Events(); len(events) != len(expected) || n.GroupExists(5) {
+		t.Fatalf("Expected no events setting the same members or unknown groups, got %v", events)
+	}
+	n.SetGroupMembers(1, nil)
+	if members := n.GroupMembers(1); len(members) != 0 || len(listener.Events()) != 6 {
+		t.Fatalf("Expected all members to be removed, got %v and %v", members, listener.Events())
+	}
+}
+
+func TestGroupMembershipDiff(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.SetGroupMembers(1, []uint64{1, 2, 3})
+	for _, test := range []struct {
+		groupID  uint32
+		desired  []uint64
+		toAdd    []uint64
+		toRemove []uint64
+	}{
+		{1, []uint64{5, 3, 2, 4}, []uint64{4, 5}, []uint64{1}},
+		{1, []uint64{4, 5}, []uint64{4, 5}, []uint64{1, 2, 3}},
+		{1, []uint64{3, 1, 2}, nil, nil},
+		{2, []uint64{1}, []uint64{1}, nil},
+	} {
+		toAdd, toRemove := n.GroupMembershipDiff(test.groupID, test.desired)
+		if !reflect.DeepEqual(toAdd, test.toAdd) || !reflect.DeepEqual(toRemove, test.toRemove) {
+			t.Errorf("Expected diff of %v to add %v and remove %v, got %v and %v", test.desired, test.toAdd, test.toRemove, toAdd, toRemove)
+		}
+	}
+	if members := n.GroupMembers(1); !reflect.DeepEqual(members, []uint64{1, 2, 3}) {
+		t.Fatalf("Expected the group not to be changed, got %v", members)
+	}
+}
+
+// membershipFuncs is a membership listener invoking a function for each membership change.
+type membershipFuncs struct {
+	added, removed func(GroupAddress, uint64)
+}
+
+func (f membershipFuncs) GroupAdded(GroupAddress)   {}
+func (f membershipFuncs) GroupUpdated(GroupAddress) {}
+func (f membershipFuncs) GroupRemoved(GroupAddress) {}
+
+func (f membershipFuncs) GroupMemberAdded(g GroupAddress, ieee uint64) {
+	if f.added != nil {
+		f.added(g, ieee)
+	}
+}
+
+func (f membershipFuncs) GroupMemberRemoved(g GroupAddress, ieee uint64) {
+	if f.removed != nil {
+		f.removed(g, ieee)
+	}
+}
+
+func TestPruneOrphanedMembershipsListenerChangingNetwork(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	n.AddGroupMember(1, 4)
+	n.AddGroupListener(membershipFuncs{removed: func(g GroupAddress, ieee uint64) {
+		n.AddDevice(testDevice(ieee, uint32(ieee)))
+	}})
+	waitDone(t, func() {
+		if count := n.PruneOrphanedMemberships(); count != 1 {
+			t.Errorf("Expected 1 membership to be pruned, got %d", count)
+		}
+	})
+	if _, ok := n.Device(NewDeviceAddress(4, 1)); !ok {
+		t.Fatal("Expected the listener to add the pruned device")
+	}
+}
+
+func TestReplayGroupsListenerChangingNetwork(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	listener := membershipFuncs{added: func(g GroupAddress, ieee uint64) {
+		n.RemoveGroupMember(g.GroupID, ieee)
+	}}
+	waitDone(t, func() {
+		n.ReplayGroups(listener)
+	})
+	if members := n.GroupMembers(1); len(members) != 0 {
+		t.Fatalf("Expected the listener to remove the replayed members, got %v", members)
+	}
+}
+
+func TestScopedGroupMembers(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "garden", Scope: 2})
+	if !n.ScopedGroupExists(2, 1) || n.ScopedGroupExists(3, 1) {
+		t.Fatal("Expected only the scoped group to exist")
+	}
+	changes := n.WatchScopedGroup(2, 1)
+	if !n.AddScopedGroupMember(2, 1, 0x10) || n.AddScopedGroupMember(3, 1, 0x10) {
+		t.Fatal("Expected members to be added to existing scoped groups only")
+	}
+	n.SetScopedGroupMembers(2, 1, []uint64{0x20, 0x30})
+	n.RemoveScopedGroupMember(2, 1, 0x30)
+	if members := n.ScopedGroupMembers(2, 1); !reflect.DeepEqual(members, []uint64{0x20}) {
+		t.Fatalf("Expected scoped group members to be changed, got %v", members)
+	}
+	if members := n.GroupMembers(1); len(members) != 0 {
+		t.Fatalf("Expected the default scope group to have no members, got %v", members)
+	}
+	var kinds []GroupChangeKind
+	for len(changes) > 0 {
+		kinds = append(kinds, (<-changes).Kind)
+	}
+	expected := []GroupChangeKind{GroupMemberAdded, GroupMemberRemoved, GroupMemberAdded, GroupMemberAdded, GroupMemberRemoved}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("Expected scoped group changes %v, got %v", expected, kinds)
+	}
+}
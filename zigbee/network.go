@@ -2,12 +2,18 @@ package zigbee
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
-
-	"github.com/pkg/errors"
+	"sync/atomic"
+	"time"
 )
 
 // NetworkListener is the interface implemented by objects who needs to be
@@ -18,89 +24,529 @@ type NetworkListener interface {
 	DeviceRemoved(Device)
 }
 
-const defaultStateFilePath = "simple-network.json"
+// GroupListener is the interface implemented by objects who needs to be
+// notified by group changes.
+type GroupListener interface {
+	GroupAdded(GroupAddress)
+	GroupUpdated(GroupAddress)
+	GroupRemoved(GroupAddress)
+}
+
+// NetworkObserver is the interface implemented by objects who needs to be
+// notified by all network, group and command events.
+type NetworkObserver interface {
+	NetworkListener
+	GroupListener
+	CommandListener
+}
+
+// ListenerHandle identifies a network listener registration.
+type ListenerHandle uint64
+
+// listenerRegistration is a network listener registered with a unique handle. Replaying registrations are not
+// notified until their replay is delivered.
+type listenerRegistration struct {
+	handle    ListenerHandle
+	listener  NetworkListener
+	replaying bool
+}
+
+// sameListener will check if the listeners are the same. Listeners of non comparable types are never the same,
+// since comparing them would panic.
+func sameListener(a, b interface{}) bool {
+	typ := reflect.TypeOf(a)
+	if typ == nil || typ != reflect.TypeOf(b) || !typ.Comparable() {
+		return false
+	}
+	return a == b
+}
+
+const (
+	defaultStateFilePath = "simple-network.json"
+	defaultStateFileMode = os.FileMode(0644)
+)
 
-// Network is the ZigBee network state implementation.
+// Network is the ZigBee network state implementation. The zero value is an empty network, ready to use with the
+// default options. Methods needing more than one lock acquire them in the order devices, groups and then listeners.
 type Network struct {
-	devices     map[string]Device
-	devicesMx   sync.RWMutex
-	groups      map[uint32]GroupAddress
-	groupsMx    sync.RWMutex
-	listeners   []NetworkListener
-	listenersMx sync.RWMutex
-	reset       bool
-	filePath    string
-}
-
-// NewNetworkState will create a new NetworkState instance.
-func NewNetworkState(reset bool) *Network {
-	return &Network{
+	droppedEvents          uint64 // accessed atomically, must stay 64-bit aligned
+	dirty                  uint32 // accessed atomically
+	dirtyShards            map[int]bool
+	allShardsDirty         bool
+	dirtyMx                sync.Mutex
+	frozen                 uint32 // accessed atomically
+	devices                map[string]Device
+	devicesMx              sync.RWMutex
+	devicesView            atomic.Value
+	devicesChanged         bool
+	deviceDispatches       []func()
+	coordinator            *Device
+	groups                 map[groupKey]GroupAddress
+	groupsMx               sync.RWMutex
+	memberships            map[groupKey]map[uint64]bool
+	groupDispatches        []func()
+	watchers               map[groupKey][]chan GroupChange
+	listeners              []listenerRegistration
+	nextListenerHandle     ListenerHandle
+	groupListeners         []GroupListener
+	listenerOrder          ListenerOrder
+	listenersMx            sync.RWMutex
+	commandListeners       []commandRegistration
+	ackListeners           []AckListener
+	unhandledHandler       func(Command)
+	commandListenersMx     sync.RWMutex
+	pending                map[CorrelationToken]chan Command
+	pendingMx              sync.Mutex
+	nextToken              CorrelationToken
+	redundantUpdateHook    func(Device)
+	updateDebounce         time.Duration
+	debounced              map[string]*debouncedUpdate
+	debounceMx             sync.Mutex
+	deviceNormalizer       func(Device) Device
+	deviceKeyFunc          func(Device) string
+	maxDevices             int
+	validateClusters       bool
+	knownClusters          map[uint32]bool
+	labelPolicy            LabelPolicy
+	reset                  bool
+	filePath               string
+	fileMode               os.FileMode
+	gzipState              bool
+	streamingSave          bool
+	stateShards            int
+	codec                  Codec
+	wal                    io.Writer
+	walMx                  sync.Mutex
+	recoverCorruption      bool
+	startupHook            func(StartupResult)
+	saveHook               func([]byte)
+	saveAttempts           int
+	saveBackoff            time.Duration
+	skipResetSave          bool
+	saved                  bool
+	lastSaveTime           time.Time
+	lastSaveErr            error
+	lastResetTime          time.Time
+	startupDuration        time.Duration
+	shutdownDuration       time.Duration
+	saveMx                 sync.Mutex
+	events                 chan func()
+	eventsDone             chan struct{}
+	eventsStopped          chan struct{}
+	eventsOnce             sync.Once
+	evictionMaxAge         time.Duration
+	evictionInterval       time.Duration
+	evictionDone           chan struct{}
+	evictionOnce           sync.Once
+	orderedNotifications   bool
+	orderMx                sync.Mutex
+	orderCond              *sync.Cond
+	reservedNotifications  uint64
+	deliveredNotifications uint64
+}
+
+// NewNetworkState will create a new NetworkState instance. When reset is true the state file is not loaded on
+// Startup, and by default the new state will overwrite it on Shutdown. Use WithoutResetSave to keep the previous
+// state file until Save is explicitly called.
+func NewNetworkState(reset bool, options ...NetworkOption) *Network {
+	n := &Network{
 		devices:   make(map[string]Device),
-		groups:    make(map[uint32]GroupAddress),
+		groups:    make(map[groupKey]GroupAddress),
 		listeners: nil,
 		reset:     reset,
 		filePath:  defaultStateFilePath,
 	}
+	for _, option := range options {
+		option(n)
+	}
+	if n.events != nil {
+		n.eventsDone = make(chan struct{})
+		n.eventsStopped = make(chan struct{})
+		go n.processEvents()
+	}
+	if n.evictionInterval > 0 {
+		n.evictionDone = make(chan struct{})
+		go n.sweepStaleDevices()
+	}
+	return n
 }
 
-// Startup will start the network.
+// Startup will start the network, loading its state from the state file, or merging all its shards.
 func (n *Network) Startup() error {
-	filePath := n.filePath
-	_, err := os.Stat(filePath)
-	if !n.reset && err == nil {
+	started := time.Now()
+	result := StartupResult{Outcome: FreshStart}
+	for _, filePath := range n.stateFilePaths() {
+		if _, err := os.Stat(filePath); n.reset || err != nil {
+			continue
+		}
 		log.Println("Loading network state.")
 		bytes, err := ioutil.ReadFile(filePath)
 		if err != nil {
-			return errors.Wrapf(err, "Unable to read content of file %s", filePath)
+			return wrapError(CodeIO, err, fmt.Sprintf("Unable to read content of file %s", filePath))
 		}
-		if err := json.Unmarshal(bytes, n); err != nil {
-			return errors.Wrapf(err, "Unable to unmarshal network state from file %s", filePath)
+		if err := n.decodeStateFile(filePath, bytes); err != nil {
+			if !n.recoverCorruption {
+				return err
+			}
+			log.Printf("Discarding corrupted network state: %v", err)
+			result.Outcome = RecoveredFromCorruption
+		} else {
+			if result.Outcome == FreshStart {
+				result.Outcome = LoadedFromFile
+			}
+			log.Println("Loading network state done.")
 		}
-		log.Println("Loading network state done.")
+	}
+	if result.Outcome == LoadedFromFile {
+		n.takeDirtyShards()
+	} else {
+		n.markAllDirty()
+	}
+	result.Duration = time.Since(started)
+	n.saveMx.Lock()
+	n.startupDuration = result.Duration
+	n.saveMx.Unlock()
+	if n.startupHook != nil {
+		result.Devices, result.Groups = n.counts()
+		n.startupHook(result)
 	}
 	return nil
 }
 
-// Shutdown will stop the network.
+// Shutdown will stop the network, saving its state if it has changed.
 func (n *Network) Shutdown() error {
+	started := time.Now()
+	defer func() {
+		n.saveMx.Lock()
+		n.shutdownDuration = time.Since(started)
+		n.saveMx.Unlock()
+	}()
+	n.stopEviction()
+	n.flushDebouncedUpdates()
+	n.stopEvents()
+	n.saveMx.Lock()
+	skip := n.reset && n.skipResetSave && !n.saved
+	n.saveMx.Unlock()
+	if skip {
+		log.Println("Skipping network state save after reset.")
+		return nil
+	}
+	return n.Flush()
+}
+
+// LastStartupDuration returns how long the last Startup took to load the network state.
+func (n *Network) LastStartupDuration() time.Duration {
+	n.saveMx.Lock()
+	defer n.saveMx.Unlock()
+	return n.startupDuration
+}
+
+// LastShutdownDuration returns how long the last Shutdown took to save the network state.
+func (n *Network) LastShutdownDuration() time.Duration {
+	n.saveMx.Lock()
+	defer n.saveMx.Unlock()
+	return n.shutdownDuration
+}
+
+// Save will save the network state to the state file. When state is sharded, all the shards are written.
+func (n *Network) Save() error {
+	n.saveMx.Lock()
+	defer n.saveMx.Unlock()
+	return n.save(true)
+}
+
+// Flush will save the network state to the state file only if it has changed since it was last loaded or saved.
+// When state is sharded, only the changed shards are written. Use Dirty to check if Flush would write anything.
+func (n *Network) Flush() error {
+	n.saveMx.Lock()
+	defer n.saveMx.Unlock()
+	if !n.Dirty() {
+		log.Println("Network state unchanged, skipping save.")
+		return nil
+	}
+	return n.save(false)
+}
+
+// save will save the network state to the state file, writing all the shards or only the changed ones. Changes made
+// while saving leave the network dirty. Caller must hold the save lock.
+func (n *Network) save(all bool) error {
 	log.Println("Saving network state.")
-	bytes, err := json.Marshal(n)
+	allDirty, dirtyShards := n.takeDirtyShards()
+	all = all || allDirty
+	err := n.writeStateFiles(func(shard int) bool {
+		return all || dirtyShards[shard]
+	})
 	if err != nil {
-		return errors.Wrapf(err, "Unable to marshal network state to file %s", n.filePath)
-	}
-	if err := ioutil.WriteFile(n.filePath, bytes, 0644); err != nil {
-		return errors.Wrapf(err, "Unabel to write content to file %s", n.filePath)
+		n.restoreDirtyShards(allDirty, dirtyShards)
+		n.lastSaveErr = err
+		return err
 	}
+	n.saved = true
+	n.lastSaveTime = time.Now()
+	n.lastSaveErr = nil
 	log.Println("Saving network state done.")
 	return nil
 }
 
+// LastSaveTime returns when the network state was last successfully saved to the state file, or the zero time if it
+// has never been saved. The error of the last save is returned if it failed, so that a failing saver can be detected.
+func (n *Network) LastSaveTime() (time.Time, error) {
+	n.saveMx.Lock()
+	defer n.saveMx.Unlock()
+	return n.lastSaveTime, n.lastSaveErr
+}
+
+// SaveTo will save the network state to the supplied path, without affecting the configured state file.
+func (n *Network) SaveTo(path string) error {
+	return n.writeStateFile(path)
+}
+
+// LoadFrom will load the network state from the supplied path, without affecting the configured state file.
+func (n *Network) LoadFrom(path string) error {
+	return n.readStateFile(path)
+}
+
 // AddGroup will add the group address to this network.
 func (n *Network) AddGroup(address GroupAddress) {
+	if n.rejectFrozen("group add") {
+		return
+	}
+	address, err := n.sanitizeGroup(address)
+	if err != nil {
+		log.Printf("Unable to add group %s: %v", address, err)
+		return
+	}
+	n.groupsMx.Lock()
+	defer n.unlockGroups()
+	n.storeGroup(address)
+	n.logGroup(walAddGroup, address)
+	n.queueGroupListeners(func(listener GroupListener) {
+		listener.GroupAdded(address)
+	})
+}
+
+// AddGroupChecked will validate the group address and add it to this network.
+func (n *Network) AddGroupChecked(address GroupAddress) error {
+	if n.Frozen() {
+		return ErrNetworkFrozen
+	}
+	address, err := n.sanitizeGroup(address)
+	if err != nil {
+		return err
+	}
+	if err := address.Validate(); err != nil {
+		return err
+	}
+	n.AddGroup(address)
+	return nil
+}
+
+// AddGroupUniqueLabel will add the group address to this network, returning an error if another group in the same
+// scope has the same label. Labels are compared ignoring surrounding spaces and case.
+func (n *Network) AddGroupUniqueLabel(address GroupAddress) error {
+	if n.Frozen() {
+		return ErrNetworkFrozen
+	}
+	address, err := n.sanitizeGroup(address)
+	if err != nil {
+		return err
+	}
+	n.groupsMx.Lock()
+	defer n.unlockGroups()
+	label := normalizeLabel(address.Label)
+	for _, group := range n.groups {
+		if group.Scope == address.Scope && group.GroupID != address.GroupID && normalizeLabel(group.Label) == label {
+			return newCodedError(CodeConflict, fmt.Sprintf("Group label %q is already used by group %d", address.Label, group.GroupID))
+		}
+	}
+	n.storeGroup(address)
+	n.logGroup(walAddGroup, address)
+	n.queueGroupListeners(func(listener GroupListener) {
+		listener.GroupAdded(address)
+	})
+	return nil
+}
+
+// GetOrCreateGroup will return the group with supplied label, compared ignoring surrounding spaces and case, creating
+// it with the id returned by newID if missing. newID is called without holding any lock, so it can read the network
+// to pick an unused id, and the lookup is repeated before creating the group, so concurrent callers get the same
+// group. A zero group address is returned if the group is missing and the network is frozen, if the label is
+// rejected by the label policy, or if the id returned by newID is invalid or already used by another group.
+func (n *Network) GetOrCreateGroup(label string, newID func() uint32) GroupAddress {
+	label, err := n.sanitizeLabel(label)
+	if err != nil {
+		log.Printf("Unable to create group: %v", err)
+		return GroupAddress{}
+	}
+	normalized := normalizeLabel(label)
+	n.groupsMx.RLock()
+	group, ok := n.groupByLabel(normalized)
+	n.groupsMx.RUnlock()
+	if ok {
+		return group
+	}
+	if n.rejectFrozen("group creation") {
+		return GroupAddress{}
+	}
+	address := GroupAddress{GroupID: newID(), Label: label}
+	if err := address.Validate(); err != nil {
+		log.Printf("Unable to create group %q: %v", label, err)
+		return GroupAddress{}
+	}
 	n.groupsMx.Lock()
-	defer n.groupsMx.Unlock()
-	n.groups[address.GroupID] = address
+	defer n.unlockGroups()
+	if group, ok := n.groupByLabel(normalized); ok {
+		return group
+	}
+	if existing, ok := n.groups[address.key()]; ok {
+		log.Printf("Unable to create group %q: group id %d is already used by group %q", label, existing.GroupID, existing.Label)
+		return GroupAddress{}
+	}
+	n.storeGroup(address)
+	n.logGroup(walAddGroup, address)
+	n.queueGroupListeners(func(listener GroupListener) {
+		listener.GroupAdded(address)
+	})
+	return address
+}
+
+// groupByLabel returns the group of the default scope with supplied normalized label. The bool value is false if
+// no such group was found. Caller must hold the groups lock.
+func (n *Network) groupByLabel(normalized string) (GroupAddress, bool) {
+	for _, group := range n.groups {
+		if group.Scope == 0 && normalizeLabel(group.Label) == normalized {
+			return group, true
+		}
+	}
+	return GroupAddress{}, false
 }
 
 // UpdateGroup will update the group address in this network.
 func (n *Network) UpdateGroup(address GroupAddress) {
+	if n.rejectFrozen("group update") {
+		return
+	}
+	address, err := n.sanitizeGroup(address)
+	if err != nil {
+		log.Printf("Unable to update group %s: %v", address, err)
+		return
+	}
 	n.groupsMx.Lock()
-	defer n.groupsMx.Unlock()
-	n.groups[address.GroupID] = address
+	defer n.unlockGroups()
+	if previous, ok := n.groups[address.key()]; ok {
+		n.groupUpdated(previous, address)
+	}
+	n.storeGroup(address)
+	n.logGroup(walUpdateGroup, address)
+	n.queueGroupListeners(func(listener GroupListener) {
+		listener.GroupUpdated(address)
+	})
 }
 
-// RemoveGroup will remove a group address from this network.
+// RemoveGroup will remove a group address, and its memberships, from this network.
 func (n *Network) RemoveGroup(address GroupAddress) {
+	if n.rejectFrozen("group removal") {
+		return
+	}
+	n.groupsMx.Lock()
+	defer n.unlockGroups()
+	n.deleteGroup(address.key())
+	n.groupRemoved(address)
+	n.logGroup(walRemoveGroup, address)
+	n.queueGroupListeners(func(listener GroupListener) {
+		listener.GroupRemoved(address)
+	})
+}
+
+// ReplaceGroups will replace all group addresses of this network with the supplied ones. Listeners are notified of
+// added, updated and removed groups once the replacement is completed, unchanged groups are not notified.
+func (n *Network) ReplaceGroups(groups []GroupAddress) {
+	if n.rejectFrozen("groups replacement") {
+		return
+	}
+	sanitized := make([]GroupAddress, len(groups))
+	for i, group := range groups {
+		group, err := n.sanitizeGroup(group)
+		if err != nil {
+			log.Printf("Unable to replace groups, group %s: %v", group, err)
+			return
+		}
+		sanitized[i] = group
+	}
+	groups = sanitized
 	n.groupsMx.Lock()
-	defer n.groupsMx.Unlock()
-	delete(n.groups, address.GroupID)
+	defer n.unlockGroups()
+	added, updated, removed := n.replaceGroups(groups)
+	n.queueGroupsDispatch(func() {
+		n.dispatchGroupChanges(added, updated, removed)
+	})
+}
+
+// replaceGroups will replace all group addresses with the supplied ones, returning the differences. Caller must hold
+// the groups write lock.
+func (n *Network) replaceGroups(groups []GroupAddress) (added, updated, removed []GroupAddress) {
+	n.initGroups()
+	replacement := make(map[groupKey]GroupAddress, len(groups))
+	for _, group := range groups {
+		replacement[group.key()] = group
+	}
+	for key, group := range n.groups {
+		if _, ok := replacement[key]; !ok {
+			n.deleteGroup(key)
+			n.groupRemoved(group)
+			n.logGroup(walRemoveGroup, group)
+			removed = append(removed, group)
+		}
+	}
+	for key, group := range replacement {
+		previous, ok := n.groups[key]
+		n.storeGroup(group)
+		if !ok {
+			n.logGroup(walAddGroup, group)
+			added = append(added, group)
+		} else if previous != group {
+			n.groupUpdated(previous, group)
+			n.logGroup(walUpdateGroup, group)
+			updated = append(updated, group)
+		}
+	}
+	return added, updated, removed
+}
+
+// dispatchGroupChanges will synchronously notify group listeners of the supplied changes.
+func (n *Network) dispatchGroupChanges(added, updated, removed []GroupAddress) {
+	for _, group := range added {
+		group := group
+		n.dispatchGroupListeners(func(listener GroupListener) {
+			listener.GroupAdded(group)
+		})
+	}
+	for _, group := range updated {
+		group := group
+		n.dispatchGroupListeners(func(listener GroupListener) {
+			listener.GroupUpdated(group)
+		})
+	}
+	for _, group := range removed {
+		group := group
+		n.dispatchGroupListeners(func(listener GroupListener) {
+			listener.GroupRemoved(group)
+		})
+	}
 }
 
-// Group will retrieve the group address for supplied group id. The bool value is false if group address was not found.
+// Group will retrieve the group address for supplied group id in the default scope. The bool value is false if group
+// address was not found.
 func (n *Network) Group(groupID uint32) (GroupAddress, bool) {
+	return n.ScopedGroup(0, groupID)
+}
+
+// ScopedGroup will retrieve the group address for supplied scope and group id. The bool value is false if group
+// address was not found.
+func (n *Network) ScopedGroup(scope, groupID uint32) (GroupAddress, bool) {
 	n.groupsMx.RLock()
 	defer n.groupsMx.RUnlock()
-	address, ok := n.groups[groupID]
+	address, ok := n.groups[groupKey{scope: scope, groupID: groupID}]
 	return address, ok
 }
 
@@ -115,124 +561,1341 @@ func (n *Network) Groups() []GroupAddress {
 	return result
 }
 
-// AddDevice will add a new device to network.
+// GroupsSorted returns a copy of group addresses sorted by group id and scope.
+func (n *Network) GroupsSorted() []GroupAddress {
+	result := n.Groups()
+	sortGroups(result)
+	return result
+}
+
+// AddDevice will add a new device to network. Devices that can't be added are logged and discarded.
 func (n *Network) AddDevice(device Device) {
-	n.devicesMx.Lock()
-	defer n.devicesMx.Unlock()
-	n.devices[device.NetworkAddress.String()] = device
-	n.listenersMx.RLock()
-	defer n.listenersMx.RUnlock()
-	for _, listener := range n.listeners {
-		listener.DeviceAdded(device)
+	if err := n.addDevice(device, false); err != nil {
+		log.Printf("Unable to add device %s: %v", device.NetworkAddress, err)
 	}
 }
 
-// UpdateDevice will update an existing device.
-func (n *Network) UpdateDevice(device Device) {
+// AddDeviceChecked will add a new device to network, returning an error if the device can't be added. Devices whose
+// IEEE address is already used by a device with a different network address are rejected, since they should replace
+// the existing device instead.
+func (n *Network) AddDeviceChecked(device Device) error {
+	return n.addDevice(device, true)
+}
+
+// addDevice will add a new device to network. Checked adds validate clusters, if enabled, and IEEE address collisions.
+func (n *Network) addDevice(device Device, checked bool) error {
+	if n.Frozen() {
+		return ErrNetworkFrozen
+	}
+	device, err := n.sanitizeDevice(n.normalizeDevice(device))
+	if err != nil {
+		return err
+	}
+	if checked && n.validateClusters {
+		if err := device.Validate(); err != nil {
+			return err
+		}
+		n.warnUnknownClusters(device)
+	}
 	n.devicesMx.Lock()
-	defer n.devicesMx.Unlock()
-	n.devices[device.NetworkAddress.String()] = device
-	n.listenersMx.RLock()
-	defer n.listenersMx.RUnlock()
-	for _, listener := range n.listeners {
-		listener.DeviceUpdated(device)
+	defer n.unlockDevices()
+	key := n.deviceKey(device)
+	if err := n.checkDeviceCapacity(key); err != nil {
+		return err
+	}
+	if checked {
+		if err := n.checkIEEECollision(device); err != nil {
+			return err
+		}
 	}
+	n.storeDevice(key, device)
+	n.logDevice(walAddDevice, device)
+	n.queueListeners(func(listener NetworkListener) {
+		listener.DeviceAdded(device)
+	})
+	return nil
 }
 
-// RemoveDevice will remove the device from network.
-func (n *Network) RemoveDevice(device Device) {
+// UpdateDevice will update an existing device. Listeners are not notified when the device is unchanged, the
+// redundant update hook is invoked instead.
+func (n *Network) UpdateDevice(device Device) {
+	if n.rejectFrozen("device update") {
+		return
+	}
+	device, err := n.sanitizeDevice(n.normalizeDevice(device))
+	if err != nil {
+		log.Printf("Unable to update device %s: %v", device.NetworkAddress, err)
+		return
+	}
 	n.devicesMx.Lock()
-	defer n.devicesMx.Unlock()
-	delete(n.devices, device.NetworkAddress.String())
-	n.listenersMx.RLock()
-	defer n.listenersMx.RUnlock()
-	for _, listener := range n.listeners {
-		listener.DeviceRemoved(device)
+	defer n.unlockDevices()
+	key := n.deviceKey(device)
+	if n.redundantUpdate(key, device) {
+		return
 	}
+	n.storeDevice(key, device)
+	n.logDevice(walUpdateDevice, device)
+	n.queueDeviceUpdated(device)
 }
 
-// Device will retrieve a device for supplied address. The bool value is false if no device is found.
-func (n *Network) Device(address Address) (Device, bool) {
-	if address.IsGroup() {
-		return Device{}, false
+// warnUnknownClusters will log the device cluster ids not in the known clusters set, if any.
+func (n *Network) warnUnknownClusters(device Device) {
+	if len(n.knownClusters) == 0 {
+		return
+	}
+	for _, ids := range [][]uint32{device.InputClusterIds, device.OutputClusterIds} {
+		for _, id := range ids {
+			if !n.knownClusters[id] {
+				log.Printf("Device %s has unknown cluster id 0x%04x", device.NetworkAddress, id)
+			}
+		}
 	}
-	n.devicesMx.RLock()
-	defer n.devicesMx.RUnlock()
-	device, ok := n.devices[address.String()]
-	return device, ok
 }
 
-// Devices will retrieve a slices of all devices.
-func (n *Network) Devices() []Device {
-	n.devicesMx.RLock()
-	defer n.devicesMx.RUnlock()
-	var result []Device
-	for _, device := range n.devices {
-		result = append(result, device)
+// checkDeviceCapacity will check that a device with supplied key can be stored without exceeding the maximum number
+// of devices. Caller must hold the devices lock.
+func (n *Network) checkDeviceCapacity(key string) error {
+	if _, ok := n.devices[key]; !ok && n.maxDevices > 0 && len(n.devices) >= n.maxDevices {
+		return newCodedError(CodeCapacity, fmt.Sprintf("Network has reached the maximum number of %d devices", n.maxDevices))
 	}
-	return result
+	return nil
 }
 
-// AddNetworkListener will add a network listener.
-func (n *Network) AddNetworkListener(listener NetworkListener) {
-	n.listenersMx.Lock()
-	defer n.listenersMx.Unlock()
-	for _, l := range n.listeners {
-		if l == listener {
-			return
+// checkMergeCapacity will check that the supplied devices can be merged into the network without exceeding the
+// maximum number of devices. Caller must hold the devices lock.
+func (n *Network) checkMergeCapacity(devices []Device) error {
+	if n.maxDevices <= 0 {
+		return nil
+	}
+	added := make(map[string]bool)
+	for _, device := range devices {
+		key := n.deviceKey(device)
+		if _, ok := n.devices[key]; !ok {
+			added[key] = true
 		}
 	}
-	n.listeners = append(n.listeners, listener)
+	if len(n.devices)+len(added) > n.maxDevices {
+		return newCodedError(CodeCapacity, fmt.Sprintf("Network can't hold %d more devices, the maximum number is %d", len(added), n.maxDevices))
+	}
+	return nil
 }
 
-// RemoveNetworkListener will remove a network listener.
-func (n *Network) RemoveNetworkListener(listener NetworkListener) {
-	n.listenersMx.Lock()
-	defer n.listenersMx.Unlock()
-	for i, l := range n.listeners {
-		if l == listener {
-			n.listeners[i] = n.listeners[len(n.listeners)-1]
-			n.listeners[len(n.listeners)-1] = nil
-			n.listeners = n.listeners[:len(n.listeners)-1]
-			return
+// checkIEEECollision will check that no device with a different network address has the IEEE address of the supplied
+// device, as happens when a rejoin is not handled. Endpoints of the same node share the IEEE address, so they don't
+// collide. Caller must hold the devices lock.
+func (n *Network) checkIEEECollision(device Device) error {
+	if device.IEEEAddress == 0 {
+		return nil
+	}
+	for _, existing := range n.devices {
+		if existing.IEEEAddress == device.IEEEAddress && existing.NetworkAddress.NetworkAddress != device.NetworkAddress.NetworkAddress {
+			return newCodedError(CodeConflict, fmt.Sprintf("IEEE address %x of device %s is already used by device %s", device.IEEEAddress, device.NetworkAddress, existing.NetworkAddress))
 		}
 	}
+	return nil
 }
 
-type serializedNetwork struct {
-	Devices []Device       `json:"devices"`
-	Groups  []GroupAddress `json:"groups"`
+// redundantUpdate will check if the device stored with supplied key is equal to the supplied one, invoking the
+// redundant update hook once the devices write lock is released if so. Caller must hold the devices write lock.
+func (n *Network) redundantUpdate(key string, device Device) bool {
+	existing, ok := n.devices[key]
+	if !ok || !existing.Equal(device) {
+		return false
+	}
+	n.queueDevicesDispatch(func() {
+		n.listenersMx.RLock()
+		hook := n.redundantUpdateHook
+		n.listenersMx.RUnlock()
+		if hook != nil {
+			hook(device)
+		}
+	})
+	return true
 }
 
-// MarshalJSON will implement custom JSON serialization.
-func (n *Network) MarshalJSON() ([]byte, error) {
+// withReadLocks will run fn holding the devices and groups read locks. Locks are always acquired in the same order:
+// devices, groups and then listeners, so that no deadlock can happen between methods needing more than one of them.
+func (n *Network) withReadLocks(fn func()) {
 	n.devicesMx.RLock()
-	n.groupsMx.RLock()
 	defer n.devicesMx.RUnlock()
+	n.groupsMx.RLock()
 	defer n.groupsMx.RUnlock()
-	// Network state is a serialization of an array of devices and groups
-	state := &serializedNetwork{
-		Devices: n.Devices(),
-		Groups:  n.Groups(),
+	fn()
+}
+
+// withWriteLocks will run fn holding the devices and groups write locks, acquired in the same order of
+// withReadLocks. Notifications queued by fn are delivered once both locks are released.
+func (n *Network) withWriteLocks(fn func()) {
+	n.devicesMx.Lock()
+	defer n.unlockDevices()
+	n.groupsMx.Lock()
+	defer n.unlockNestedGroups()
+	fn()
+}
+
+// devicesSnapshot returns the devices map published for lock free readers. The returned map must not be modified.
+func (n *Network) devicesSnapshot() map[string]Device {
+	devices, _ := n.devicesView.Load().(map[string]Device)
+	return devices
+}
+
+// unlockDevices will publish a copy of the devices map for lock free readers, if changed, release the devices write
+// lock and then deliver the queued notifications, so that listeners read the published devices. Writers pay the copy
+// so that frequent readers never contend on the devices lock.
+func (n *Network) unlockDevices() {
+	if n.devicesChanged {
+		snapshot := make(map[string]Device, len(n.devices))
+		for key, device := range n.devices {
+			snapshot[key] = device
+		}
+		n.devicesView.Store(snapshot)
+		n.devicesChanged = false
 	}
-	return json.Marshal(state)
+	dispatches := n.deviceDispatches
+	n.deviceDispatches = nil
+	n.unlockNotifying(&n.devicesMx, dispatches)
 }
 
-// UnmarshalJSON will implement custom JSON deserialization.
-func (n *Network) UnmarshalJSON(data []byte) error {
-	var state serializedNetwork
-	if err := json.Unmarshal(data, &state); err != nil {
-		return err
+// storeDevice will store the device with supplied key in the devices map, marking the network state as changed.
+// Caller must hold the devices write lock.
+func (n *Network) storeDevice(key string, device Device) {
+	n.initDevices()
+	if previous, ok := n.devices[key]; ok && previous.NetworkAddress != device.NetworkAddress {
+		n.markDeviceDirty(previous.NetworkAddress)
+	}
+	n.devices[key] = device
+	n.devicesChanged = true
+	n.markDeviceDirty(device.NetworkAddress)
+}
+
+// deleteDevice will delete the device with supplied key from the devices map, marking the network state as changed.
+// The bool value is false if the device was missing. Caller must hold the devices write lock.
+func (n *Network) deleteDevice(key string) bool {
+	device, ok := n.devices[key]
+	if !ok {
+		return false
+	}
+	delete(n.devices, key)
+	n.devicesChanged = true
+	n.markDeviceDirty(device.NetworkAddress)
+	return true
+}
+
+// storeGroup will store the group in the groups map, marking the network state as changed unless the group is
+// already stored. Caller must hold the groups write lock.
+func (n *Network) storeGroup(group GroupAddress) {
+	n.initGroups()
+	if previous, ok := n.groups[group.key()]; ok && previous == group {
+		return
+	}
+	n.groups[group.key()] = group
+	n.markDirty()
+}
+
+// deleteGroup will delete the group with supplied key from the groups map, marking the network state as changed.
+// Caller must hold the groups write lock.
+func (n *Network) deleteGroup(key groupKey) {
+	if _, ok := n.groups[key]; !ok {
+		return
+	}
+	delete(n.groups, key)
+	n.markDirty()
+}
+
+// unlockGroups will release the groups write lock and then deliver the queued notifications.
+func (n *Network) unlockGroups() {
+	dispatches := n.groupDispatches
+	n.groupDispatches = nil
+	n.unlockNotifying(&n.groupsMx, dispatches)
+}
+
+// unlockNestedGroups will release the groups write lock acquired while holding the devices write lock. The queued
+// group notifications are handed over to unlockDevices, so that listeners are notified once both locks are released.
+// Caller must hold the devices write lock.
+func (n *Network) unlockNestedGroups() {
+	n.deviceDispatches = append(n.deviceDispatches, n.groupDispatches...)
+	n.groupDispatches = nil
+	n.groupsMx.Unlock()
+}
+
+// markDirty will mark the network state as changed since it was last loaded or saved. It's called when a change is
+// committed, so that operations leaving the network unchanged don't cause a write on Flush. Groups, memberships and
+// coordinator are stored in the first shard, which is marked as changed.
+func (n *Network) markDirty() {
+	n.markShardDirty(0)
+}
+
+// markDeviceDirty will mark as changed the shard storing the device with supplied network address.
+func (n *Network) markDeviceDirty(address DeviceAddress) {
+	if !n.sharded() {
+		n.markShardDirty(0)
+		return
+	}
+	n.markShardDirty(shardIndex(address, n.stateShards))
+}
+
+// markShardDirty will mark the network state, and the shard with supplied index, as changed.
+func (n *Network) markShardDirty(shard int) {
+	n.dirtyMx.Lock()
+	defer n.dirtyMx.Unlock()
+	if n.dirtyShards == nil {
+		n.dirtyShards = make(map[int]bool)
+	}
+	n.dirtyShards[shard] = true
+	atomic.StoreUint32(&n.dirty, 1)
+}
+
+// markAllDirty will mark the network state, and all its shards, as changed, so that the next Flush writes all the
+// state files.
+func (n *Network) markAllDirty() {
+	n.dirtyMx.Lock()
+	defer n.dirtyMx.Unlock()
+	n.allShardsDirty = true
+	atomic.StoreUint32(&n.dirty, 1)
+}
+
+// takeDirtyShards will clear the changes of the network state, returning the indexes of the changed shards, or true
+// if all the shards are changed.
+func (n *Network) takeDirtyShards() (bool, map[int]bool) {
+	n.dirtyMx.Lock()
+	defer n.dirtyMx.Unlock()
+	all, shards := n.allShardsDirty, n.dirtyShards
+	n.allShardsDirty, n.dirtyShards = false, nil
+	atomic.StoreUint32(&n.dirty, 0)
+	return all, shards
+}
+
+// restoreDirtyShards will mark again as changed the shards returned by takeDirtyShards, when they couldn't be saved.
+func (n *Network) restoreDirtyShards(all bool, shards map[int]bool) {
+	if all {
+		n.markAllDirty()
+	}
+	for shard := range shards {
+		n.markShardDirty(shard)
+	}
+}
+
+// Dirty returns true if the network state has changed since it was last loaded or saved, and Flush would write it.
+func (n *Network) Dirty() bool {
+	return atomic.LoadUint32(&n.dirty) == 1
+}
+
+// initDevices will create the devices map of a zero value network. Caller must hold the devices write lock.
+func (n *Network) initDevices() {
+	if n.devices == nil {
+		n.devices = make(map[string]Device)
+	}
+}
+
+// initGroups will create the groups map of a zero value network. Caller must hold the groups write lock.
+func (n *Network) initGroups() {
+	if n.groups == nil {
+		n.groups = make(map[groupKey]GroupAddress)
+	}
+}
+
+// stateFilePath returns the path of the state file.
+func (n *Network) stateFilePath() string {
+	if n.filePath == "" {
+		return defaultStateFilePath
+	}
+	return n.filePath
+}
+
+// deviceKey returns the key identifying the device in the devices map.
+func (n *Network) deviceKey(device Device) string {
+	if n.deviceKeyFunc == nil {
+		return device.NetworkAddress.String()
+	}
+	return n.deviceKeyFunc(device)
+}
+
+// stateFileMode returns the permissions of the state files.
+func (n *Network) stateFileMode() os.FileMode {
+	if n.fileMode == 0 {
+		return defaultStateFileMode
+	}
+	return n.fileMode
+}
+
+// normalizeDevice will apply the configured device normalizer. The network address can't be changed by the
+// normalizer, since it identifies the device in this network.
+func (n *Network) normalizeDevice(device Device) Device {
+	if n.deviceNormalizer == nil {
+		return device
+	}
+	normalized := n.deviceNormalizer(device)
+	normalized.NetworkAddress = device.NetworkAddress
+	return normalized
+}
+
+// RemoveDevice will remove the device from network. Group memberships are removed with the last device having its
+// IEEE address.
+func (n *Network) RemoveDevice(device Device) {
+	if n.rejectFrozen("device removal") {
+		return
 	}
 	n.devicesMx.Lock()
-	n.groupsMx.Lock()
-	defer n.devicesMx.Unlock()
-	defer n.groupsMx.Unlock()
-	for _, device := range state.Devices {
-		n.devices[device.NetworkAddress.String()] = device
+	defer n.unlockDevices()
+	if n.deleteDevice(n.deviceKey(device)) {
+		n.logDevice(walRemoveDevice, device)
 	}
-	for _, group := range state.Groups {
-		n.groups[group.GroupID] = group
+	n.removeMemberships(device.IEEEAddress)
+	n.queueDeviceRemoved(device)
+}
+
+// RemoveDeviceByIEEE will remove the device with supplied IEEE address from network. When several endpoints of a node
+// share the IEEE address, only the one with the lowest network address and endpoint is removed. Group memberships are
+// removed with the last device having the IEEE address. The bool value is false if no device was found.
+func (n *Network) RemoveDeviceByIEEE(ieee uint64) bool {
+	if n.rejectFrozen("device removal") {
+		return false
+	}
+	n.devicesMx.Lock()
+	defer n.unlockDevices()
+	key, ok := n.deviceKeyByIEEE(ieee)
+	if !ok {
+		return false
+	}
+	device := n.devices[key]
+	n.deleteDevice(key)
+	n.logDevice(walRemoveDevice, device)
+	n.removeMemberships(ieee)
+	n.queueDeviceRemoved(device)
+	return true
+}
+
+// RemoveDevicesWhere will remove all devices satisfying the supplied predicate, and their group memberships,
+// returning the number of removed devices. Listeners are notified of removed devices once all of them have been
+// removed.
+func (n *Network) RemoveDevicesWhere(predicate func(Device) bool) int {
+	if n.rejectFrozen("devices removal") {
+		return 0
+	}
+	n.devicesMx.Lock()
+	defer n.unlockDevices()
+	var removed []Device
+	for key, device := range n.devices {
+		if predicate(device) {
+			n.deleteDevice(key)
+			n.logDevice(walRemoveDevice, device)
+			removed = append(removed, device)
+		}
+	}
+	for _, device := range removed {
+		n.removeMemberships(device.IEEEAddress)
+		n.cancelDebouncedUpdate(device)
+	}
+	n.queueDevicesDispatch(func() {
+		n.dispatchDeviceChanges(nil, nil, removed)
+	})
+	return len(removed)
+}
+
+// ReplaceDevices will replace all devices of this network with the supplied ones. Group memberships of removed
+// devices are removed. Listeners are notified of added, updated and removed devices once the replacement is
+// completed, unchanged devices are not notified. Devices are normalized and sanitized as done by AddDevice, and the
+// network is left unchanged if a device is rejected or if the supplied devices exceed the maximum number of devices.
+func (n *Network) ReplaceDevices(devices []Device) {
+	if n.rejectFrozen("devices replacement") {
+		return
+	}
+	sanitized := make([]Device, len(devices))
+	keys := make(map[string]bool, len(devices))
+	for i, device := range devices {
+		device, err := n.sanitizeDevice(n.normalizeDevice(device))
+		if err != nil {
+			log.Printf("Unable to replace devices, device %s: %v", device.NetworkAddress, err)
+			return
+		}
+		sanitized[i] = device
+		keys[n.deviceKey(device)] = true
+	}
+	if n.maxDevices > 0 && len(keys) > n.maxDevices {
+		err := newCodedError(CodeCapacity, fmt.Sprintf("Network can't hold %d devices, the maximum number is %d", len(keys), n.maxDevices))
+		log.Printf("Unable to replace devices: %v", err)
+		return
+	}
+	devices = sanitized
+	n.devicesMx.Lock()
+	defer n.unlockDevices()
+	added, updated, removed := n.replaceDevices(devices)
+	for _, device := range removed {
+		n.removeMemberships(device.IEEEAddress)
+		n.cancelDebouncedUpdate(device)
+	}
+	n.queueDevicesDispatch(func() {
+		n.dispatchDeviceChanges(added, updated, removed)
+	})
+}
+
+// replaceDevices will replace all devices with the supplied normalized ones, returning the differences. Caller must
+// hold the devices write lock.
+func (n *Network) replaceDevices(devices []Device) (added, updated, removed []Device) {
+	n.initDevices()
+	replacement := make(map[string]Device, len(devices))
+	for _, device := range devices {
+		replacement[n.deviceKey(device)] = device
+	}
+	for key, device := range n.devices {
+		if _, ok := replacement[key]; !ok {
+			n.deleteDevice(key)
+			n.logDevice(walRemoveDevice, device)
+			removed = append(removed, device)
+		}
+	}
+	for key, device := range replacement {
+		previous, ok := n.devices[key]
+		if !ok {
+			n.storeDevice(key, device)
+			n.logDevice(walAddDevice, device)
+			added = append(added, device)
+		} else if !previous.Equal(device) {
+			n.storeDevice(key, device)
+			n.logDevice(walUpdateDevice, device)
+			updated = append(updated, device)
+		}
+	}
+	return added, updated, removed
+}
+
+// dispatchDeviceChanges will synchronously notify network listeners of the supplied changes.
+func (n *Network) dispatchDeviceChanges(added, updated, removed []Device) {
+	for _, device := range added {
+		device := device
+		n.dispatchListeners(func(listener NetworkListener) {
+			listener.DeviceAdded(device)
+		})
+	}
+	for _, device := range updated {
+		device := device
+		n.dispatchListeners(func(listener NetworkListener) {
+			listener.DeviceUpdated(device)
+		})
+	}
+	for _, device := range removed {
+		device := device
+		n.dispatchListeners(func(listener NetworkListener) {
+			listener.DeviceRemoved(device)
+		})
+	}
+}
+
+// Device will retrieve a device for supplied address. The bool value is false if no device is found, or if the
+// address is a group or broadcast address. When a custom device key is configured and more than one device has the
+// address, any of them is returned.
+func (n *Network) Device(address Address) (Device, bool) {
+	if address.IsGroup() {
+		return Device{}, false
+	}
+	if deviceAddress, ok := address.(DeviceAddress); ok && deviceAddress.IsBroadcast() {
+		return Device{}, false
+	}
+	devices := n.devicesSnapshot()
+	if n.deviceKeyFunc == nil {
+		device, ok := devices[address.String()]
+		return device, ok
+	}
+	for _, device := range devices {
+		if device.NetworkAddress.String() == address.String() {
+			return device, true
+		}
+	}
+	return Device{}, false
+}
+
+// DeviceExists will check if a device with supplied address is in the network. Group and broadcast addresses never
+// identify a device.
+func (n *Network) DeviceExists(address Address) bool {
+	if n.deviceKeyFunc != nil {
+		_, ok := n.Device(address)
+		return ok
+	}
+	if address.IsGroup() {
+		return false
+	}
+	if deviceAddress, ok := address.(DeviceAddress); ok && deviceAddress.IsBroadcast() {
+		return false
+	}
+	_, ok := n.devicesSnapshot()[address.String()]
+	return ok
+}
+
+// GroupExists will check if a group with supplied id is in the default scope of the network.
+func (n *Network) GroupExists(groupID uint32) bool {
+	return n.ScopedGroupExists(0, groupID)
+}
+
+// ScopedGroupExists will check if a group with supplied scope and id is in the network.
+func (n *Network) ScopedGroupExists(scope, groupID uint32) bool {
+	_, ok := n.ScopedGroup(scope, groupID)
+	return ok
+}
+
+// Resolve will retrieve the current device with supplied address. The bool value is false if the address is a group
+// or broadcast address, or no device is found. Use ResolveByAny to resolve devices whose network address may have
+// changed.
+func (n *Network) Resolve(address Address) (Device, bool) {
+	return n.Device(address)
+}
+
+// ResolveByAny will retrieve the current device with supplied IEEE address, falling back to the supplied network
+// address when no device has the IEEE address. Since network addresses change on rejoin, the IEEE address is preferred.
+// When the IEEE address identifies more than one endpoint, the one with the endpoint of the supplied address is
+// returned, or the lowest one if no endpoint matches. The bool value is false if no device is found.
+func (n *Network) ResolveByAny(ieee uint64, address DeviceAddress) (Device, bool) {
+	var result Device
+	found := false
+	for _, device := range n.devicesSnapshot() {
+		if device.IEEEAddress != ieee {
+			continue
+		}
+		if device.NetworkAddress.Endpoint == address.Endpoint {
+			return device, true
+		}
+		if !found || device.NetworkAddress.Less(result.NetworkAddress) {
+			result, found = device, true
+		}
+	}
+	if found {
+		return result, true
+	}
+	return n.Device(address)
+}
+
+// Devices will retrieve a slices of all devices.
+func (n *Network) Devices() []Device {
+	var result []Device
+	for _, device := range n.devicesSnapshot() {
+		result = append(result, device)
+	}
+	return result
+}
+
+// DevicesSorted will retrieve a slice of all devices sorted by network address and endpoint.
+func (n *Network) DevicesSorted() []Device {
+	result := n.Devices()
+	sortDevices(result)
+	return result
+}
+
+// DevicesMatching will retrieve a slice of devices whose address matches the supplied pattern.
+func (n *Network) DevicesMatching(pattern DeviceAddressPattern) []Device {
+	return n.devicesWhere(func(device Device) bool {
+		return pattern.Matches(device.NetworkAddress)
+	})
+}
+
+// DevicesWithVersion will retrieve a slice of devices with the supplied device version. Version semantics are
+// device specific, so versions are only comparable between devices of the same kind.
+func (n *Network) DevicesWithVersion(version uint32) []Device {
+	return n.devicesWhere(func(device Device) bool {
+		return device.DeviceVersion == version
+	})
+}
+
+// DevicesWithVersionBelow will retrieve a slice of devices with a device version lower than the supplied one.
+// Version semantics are device specific, so versions are only comparable between devices of the same kind.
+func (n *Network) DevicesWithVersionBelow(version uint32) []Device {
+	return n.devicesWhere(func(device Device) bool {
+		return device.DeviceVersion < version
+	})
+}
+
+// DevicesWithoutInputClusters will retrieve a slice of devices not advertising any input cluster.
+func (n *Network) DevicesWithoutInputClusters() []Device {
+	return n.devicesWhere(func(device Device) bool {
+		return len(device.InputClusterIds) == 0
+	})
+}
+
+// ApplicationDevices will retrieve a slice of devices whose endpoint is in the application endpoints range.
+func (n *Network) ApplicationDevices() []Device {
+	return n.devicesWhere(Device.IsApplicationEndpoint)
+}
+
+// ZDODevices will retrieve a slice of devices whose endpoint is not in the application endpoints range, that is the
+// ZDO pseudo-devices and the devices on reserved endpoints. It's the complement of ApplicationDevices.
+func (n *Network) ZDODevices() []Device {
+	return n.devicesWhere(func(device Device) bool {
+		return !device.IsApplicationEndpoint()
+	})
+}
+
+// DevicesByClusterCount will retrieve a slice of devices whose number of input and output clusters is between min
+// and max, inclusive.
+func (n *Network) DevicesByClusterCount(min, max int) []Device {
+	return n.devicesWhere(func(device Device) bool {
+		count := len(device.InputClusterIds) + len(device.OutputClusterIds)
+		return count >= min && count <= max
+	})
+}
+
+// DevicesNotSeenSince will retrieve a slice of devices last seen before the supplied time, including devices never
+// seen.
+func (n *Network) DevicesNotSeenSince(t time.Time) []Device {
+	return n.devicesWhere(func(device Device) bool {
+		return device.LastSeen.Before(t)
+	})
+}
+
+// devicesWhere will retrieve a slice of devices satisfying the supplied predicate.
+func (n *Network) devicesWhere(predicate func(Device) bool) []Device {
+	var result []Device
+	for _, device := range n.devicesSnapshot() {
+		if predicate(device) {
+			result = append(result, device)
+		}
+	}
+	return result
+}
+
+// AllInputClusters returns the sorted union of input cluster ids of all devices.
+func (n *Network) AllInputClusters() []uint32 {
+	return n.allClusters(func(device Device) []uint32 {
+		return device.InputClusterIds
+	})
+}
+
+// AllOutputClusters returns the sorted union of output cluster ids of all devices.
+func (n *Network) AllOutputClusters() []uint32 {
+	return n.allClusters(func(device Device) []uint32 {
+		return device.OutputClusterIds
+	})
+}
+
+func (n *Network) allClusters(clusterIds func(Device) []uint32) []uint32 {
+	seen := make(map[uint32]bool)
+	var result []uint32
+	for _, device := range n.devicesSnapshot() {
+		for _, id := range clusterIds(device) {
+			if !seen[id] {
+				seen[id] = true
+				result = append(result, id)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// OnRedundantUpdate will register a hook invoked when UpdateDevice is called with an unchanged device. The hook is
+// invoked as a notification, once the network locks are released, so it can read and change the network. A nil hook
+// removes the registered one.
+func (n *Network) OnRedundantUpdate(hook func(Device)) {
+	n.listenersMx.Lock()
+	defer n.listenersMx.Unlock()
+	n.redundantUpdateHook = hook
+}
+
+// AddNetworkListener will add a network listener, returning the handle of its registration. Adding a listener
+// already registered returns the existing handle. A nil listener is ignored and a zero handle is returned.
+func (n *Network) AddNetworkListener(listener NetworkListener) ListenerHandle {
+	if listener == nil {
+		return 0
+	}
+	n.listenersMx.Lock()
+	defer n.listenersMx.Unlock()
+	if handle, ok := n.listenerHandle(listener); ok {
+		return handle
+	}
+	return n.registerListener(listener)
+}
+
+// AddNetworkListenerWithReplay will add a network listener, notifying it of every device already in the network as
+// added. The replay is delivered as a notification, after releasing the devices lock and in order with the other
+// notifications, so the listener can read and change the network and sees every device exactly once before any
+// later change. When asynchronous notifications are enabled, the listener isn't notified of the changes queued
+// before its registration, since they are part of the replay.
+func (n *Network) AddNetworkListenerWithReplay(listener NetworkListener) ListenerHandle {
+	if listener == nil {
+		return 0
+	}
+	n.devicesMx.Lock()
+	defer n.unlockDevices()
+	n.listenersMx.Lock()
+	handle, registered := n.listenerHandle(listener)
+	if !registered {
+		handle = n.registerListener(listener)
+		n.listeners[len(n.listeners)-1].replaying = n.events != nil
+	}
+	n.listenersMx.Unlock()
+	devices := n.devicesSnapshot()
+	n.queueDevicesDispatch(func() {
+		if !n.replayListener(handle) {
+			return
+		}
+		for _, device := range devices {
+			listener.DeviceAdded(device)
+		}
+	})
+	return handle
+}
+
+// listenerHandle returns the handle of the registration of the supplied listener. The bool value is false if the
+// listener is not registered. Caller must hold the listeners lock.
+func (n *Network) listenerHandle(listener NetworkListener) (ListenerHandle, bool) {
+	for _, registration := range n.listeners {
+		if sameListener(registration.listener, listener) {
+			return registration.handle, true
+		}
+	}
+	return 0, false
+}
+
+// replayListener will start notifying the listener registration with supplied handle, which was skipped while its
+// replay was queued. The bool value is false if the registration has been removed in the meantime.
+func (n *Network) replayListener(handle ListenerHandle) bool {
+	n.listenersMx.Lock()
+	defer n.listenersMx.Unlock()
+	for i := range n.listeners {
+		if n.listeners[i].handle == handle {
+			n.listeners[i].replaying = false
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe will add a network listener, returning a function removing this registration. Registering the same
+// listener more than once will notify it once per registration. A nil listener is ignored.
+func (n *Network) Subscribe(listener NetworkListener) (unsubscribe func()) {
+	if listener == nil {
+		return func() {}
+	}
+	n.listenersMx.Lock()
+	defer n.listenersMx.Unlock()
+	handle := n.registerListener(listener)
+	return func() {
+		n.RemoveNetworkListenerHandle(handle)
+	}
+}
+
+// RemoveNetworkListenerHandle will remove the network listener registration with supplied handle.
+func (n *Network) RemoveNetworkListenerHandle(handle ListenerHandle) {
+	n.listenersMx.Lock()
+	defer n.listenersMx.Unlock()
+	for i, registration := range n.listeners {
+		if registration.handle == handle {
+			n.removeListenerAt(i)
+			return
+		}
+	}
+}
+
+// registerListener will add a listener registration, returning its handle. Caller must hold the listeners lock.
+func (n *Network) registerListener(listener NetworkListener) ListenerHandle {
+	n.nextListenerHandle++
+	n.listeners = append(n.listeners, listenerRegistration{handle: n.nextListenerHandle, listener: listener})
+	return n.nextListenerHandle
+}
+
+// removeListenerAt will remove the listener registration at supplied index, preserving the registration order of
+// the other listeners. Caller must hold the listeners lock.
+func (n *Network) removeListenerAt(i int) {
+	last := len(n.listeners) - 1
+	copy(n.listeners[i:], n.listeners[i+1:])
+	n.listeners[last] = listenerRegistration{}
+	n.listeners = n.listeners[:last]
+}
+
+// AddGroupListener will add a group listener. A nil listener is ignored.
+func (n *Network) AddGroupListener(listener GroupListener) {
+	if listener == nil {
+		return
+	}
+	n.listenersMx.Lock()
+	defer n.listenersMx.Unlock()
+	for _, l := range n.groupListeners {
+		if sameListener(l, listener) {
+			return
+		}
+	}
+	n.groupListeners = append(n.groupListeners, listener)
+}
+
+// RemoveGroupListener will remove a group listener.
+func (n *Network) RemoveGroupListener(listener GroupListener) {
+	n.listenersMx.Lock()
+	defer n.listenersMx.Unlock()
+	for i, l := range n.groupListeners {
+		if sameListener(l, listener) {
+			last := len(n.groupListeners) - 1
+			copy(n.groupListeners[i:], n.groupListeners[i+1:])
+			n.groupListeners[last] = nil
+			n.groupListeners = n.groupListeners[:last]
+			return
+		}
+	}
+}
+
+// RegisterObserver will register the observer as network, group and command listener.
+func (n *Network) RegisterObserver(observer NetworkObserver) {
+	if observer == nil {
+		return
+	}
+	n.AddNetworkListener(observer)
+	n.AddGroupListener(observer)
+	n.AddCommandListener(observer)
+}
+
+// UnregisterObserver will remove the observer from network, group and command listeners.
+func (n *Network) UnregisterObserver(observer NetworkObserver) {
+	if observer == nil {
+		return
+	}
+	n.RemoveNetworkListener(observer)
+	n.RemoveGroupListener(observer)
+	n.RemoveCommandListener(observer)
+}
+
+// RemoveNetworkListener will remove a network listener. Listeners of non comparable types can only be removed
+// using RemoveNetworkListenerHandle.
+func (n *Network) RemoveNetworkListener(listener NetworkListener) {
+	n.listenersMx.Lock()
+	defer n.listenersMx.Unlock()
+	for i, registration := range n.listeners {
+		if sameListener(registration.listener, listener) {
+			n.removeListenerAt(i)
+			return
+		}
+	}
+}
+
+// ListenerCount returns the number of registered network listeners.
+func (n *Network) ListenerCount() int {
+	n.listenersMx.RLock()
+	defer n.listenersMx.RUnlock()
+	return len(n.listeners)
+}
+
+// deviceKeyByIEEE will find the key of the device with supplied IEEE address. Caller must hold the devices lock.
+func (n *Network) deviceKeyByIEEE(ieee uint64) (string, bool) {
+	key, _, ok := deviceByIEEE(n.devices, ieee)
+	return key, ok
+}
+
+// deviceByIEEE will find the device with supplied IEEE address and its key. The endpoints of a node share the IEEE
+// address, so the one with the lowest network address and endpoint is chosen, and the IEEE based helpers always read
+// and change the same device.
+func deviceByIEEE(devices map[string]Device, ieee uint64) (string, Device, bool) {
+	var (
+		resultKey string
+		result    Device
+		found     bool
+	)
+	for key, device := range devices {
+		if device.IEEEAddress == ieee && (!found || device.NetworkAddress.Less(result.NetworkAddress)) {
+			resultKey, result, found = key, device, true
+		}
+	}
+	return resultKey, result, found
+}
+
+// updateDeviceByIEEE will apply the supplied mutation to the device with supplied IEEE address, the lowest endpoint
+// if the node has several, notifying listeners of the update. The bool value is false if no device is found.
+func (n *Network) updateDeviceByIEEE(ieee uint64, mutate func(*Device)) bool {
+	if n.rejectFrozen("device update") {
+		return false
+	}
+	n.devicesMx.Lock()
+	defer n.unlockDevices()
+	key, ok := n.deviceKeyByIEEE(ieee)
+	if !ok {
+		return false
+	}
+	device := n.devices[key]
+	mutate(&device)
+	n.storeDevice(key, device)
+	n.logDevice(walUpdateDevice, device)
+	n.queueDeviceUpdated(device)
+	return true
+}
+
+// SetMetadata will set a metadata value on the device with supplied IEEE address. When several endpoints of a node
+// share the IEEE address, the one with the lowest network address and endpoint is changed, and it's the one read by
+// Metadata. The bool value is false if no device is found.
+func (n *Network) SetMetadata(ieee uint64, key, value string) bool {
+	return n.updateDeviceByIEEE(ieee, func(device *Device) {
+		// Metadata is copied since the previous map may be shared with devices returned to callers
+		device.Metadata = cloneMetadata(device.Metadata)
+		if device.Metadata == nil {
+			device.Metadata = make(map[string]string)
+		}
+		device.Metadata[key] = value
+	})
+}
+
+// SetDeviceLabel will set the label of the device with supplied IEEE address, the lowest endpoint if the node has
+// several. The bool value is false if no device is found.
+func (n *Network) SetDeviceLabel(ieee uint64, label string) bool {
+	label, err := n.sanitizeLabel(label)
+	if err != nil {
+		log.Printf("Unable to set label of device %x: %v", ieee, err)
+		return false
+	}
+	return n.updateDeviceByIEEE(ieee, func(device *Device) {
+		device.Label = label
+	})
+}
+
+// SetDeviceVersion will set the version of the device with supplied IEEE address, the lowest endpoint if the node
+// has several, leaving other fields unchanged. The bool value is false if no device is found.
+func (n *Network) SetDeviceVersion(ieee uint64, version uint32) bool {
+	return n.updateDeviceByIEEE(ieee, func(device *Device) {
+		device.DeviceVersion = version
+	})
+}
+
+// SetDeviceEnabled will enable or disable the device with supplied IEEE address, the lowest endpoint if the node has
+// several. Commands addressed to disabled
+// devices are not dispatched. The bool value is false if no device is found.
+func (n *Network) SetDeviceEnabled(ieee uint64, enabled bool) bool {
+	return n.updateDeviceByIEEE(ieee, func(device *Device) {
+		device.Disabled = !enabled
+	})
+}
+
+// Touch will set the last seen time of the device with supplied IEEE address, the lowest endpoint if the node has
+// several, to now. The bool value is false if no device is found.
+func (n *Network) Touch(ieee uint64) bool {
+	return n.updateDeviceByIEEE(ieee, func(device *Device) {
+		device.LastSeen = time.Now()
+	})
+}
+
+// Metadata will retrieve a metadata value of the device with supplied IEEE address, the lowest endpoint if the node
+// has several. The bool value is false if no device or metadata value is found.
+func (n *Network) Metadata(ieee uint64, key string) (string, bool) {
+	_, device, ok := deviceByIEEE(n.devicesSnapshot(), ieee)
+	if !ok {
+		return "", false
+	}
+	value, ok := device.Metadata[key]
+	return value, ok
+}
+
+// SetAttribute will cache the last reported value of an attribute of the device with supplied IEEE address, the
+// lowest endpoint if the node has several. Values are persisted with the network state as JSON, so numbers are
+// restored as float64. The bool value is false if no device is found.
+func (n *Network) SetAttribute(ieee uint64, cluster, attribute uint32, value interface{}) bool {
+	return n.updateDeviceByIEEE(ieee, func(device *Device) {
+		// Attributes are copied since the previous maps may be shared with devices returned to callers
+		device.Attributes = cloneAttributes(device.Attributes)
+		if device.Attributes == nil {
+			device.Attributes = make(map[uint32]map[uint32]interface{})
+		}
+		if device.Attributes[cluster] == nil {
+			device.Attributes[cluster] = make(map[uint32]interface{})
+		}
+		device.Attributes[cluster][attribute] = value
+	})
+}
+
+// GetAttribute will retrieve the cached value of an attribute of the device with supplied IEEE address, the lowest
+// endpoint if the node has several, as changed by SetAttribute. The bool value is false if no device or attribute
+// value is found.
+func (n *Network) GetAttribute(ieee uint64, cluster, attribute uint32) (interface{}, bool) {
+	_, device, ok := deviceByIEEE(n.devicesSnapshot(), ieee)
+	if !ok {
+		return nil, false
+	}
+	value, ok := device.Attributes[cluster][attribute]
+	return value, ok
+}
+
+// CheckIntegrity will check the network state invariants, returning an error for each detected problem. An empty
+// result means the network state is healthy.
+func (n *Network) CheckIntegrity() []error {
+	var problems []error
+	n.withReadLocks(func() {
+		addressesByIEEE := make(map[uint64]map[uint32]bool)
+		for key, device := range n.devices {
+			if device.IEEEAddress == 0 {
+				problems = append(problems, newCodedError(CodeIntegrity, fmt.Sprintf("Device %s has a zero IEEE address", key)))
+				continue
+			}
+			if err := device.Validate(); err != nil {
+				problems = append(problems, err)
+			}
+			if addressesByIEEE[device.IEEEAddress] == nil {
+				addressesByIEEE[device.IEEEAddress] = make(map[uint32]bool)
+			}
+			addressesByIEEE[device.IEEEAddress][device.NetworkAddress.NetworkAddress] = true
+		}
+		// Endpoints of the same node share the IEEE address, so only different network addresses are a problem
+		for ieee, addresses := range addressesByIEEE {
+			if len(addresses) > 1 {
+				var list []string
+				for address := range addresses {
+					list = append(list, strconv.FormatUint(uint64(address), 10))
+				}
+				sort.Strings(list)
+				problems = append(problems, newCodedError(CodeIntegrity, fmt.Sprintf("IEEE address %x is used by network addresses %s", ieee, strings.Join(list, ", "))))
+			}
+		}
+		for key, orphans := range n.orphanedMemberships() {
+			for _, ieee := range orphans {
+				problems = append(problems, newCodedError(CodeIntegrity, fmt.Sprintf("Group %d has member %x with no device", key.groupID, ieee)))
+			}
+		}
+	})
+	return problems
+}
+
+// Equal will check if the network holds the same devices, groups and group memberships of the other one. Both
+// networks are read locked, in an order depending on their addresses to avoid deadlocks with concurrent calls.
+func (n *Network) Equal(other *Network) bool {
+	if n == other {
+		return true
+	}
+	if other == nil {
+		return false
+	}
+	first, second := n, other
+	if reflect.ValueOf(second).Pointer() < reflect.ValueOf(first).Pointer() {
+		first, second = second, first
+	}
+	equal := false
+	first.withReadLocks(func() {
+		second.withReadLocks(func() {
+			equal = equalDevices(n.devices, other.devices) &&
+				equalGroups(n.groups, other.groups) &&
+				equalMemberships(n.memberships, other.memberships) &&
+				equalCoordinators(n.coordinator, other.coordinator)
+		})
+	})
+	return equal
+}
+
+func equalCoordinators(a, b *Device) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func equalDevices(a, b map[string]Device) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, device := range a {
+		if otherDevice, ok := b[key]; !ok || !device.Equal(otherDevice) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalGroups(a, b map[groupKey]GroupAddress) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, group := range a {
+		if otherGroup, ok := b[key]; !ok || group != otherGroup {
+			return false
+		}
+	}
+	return true
+}
+
+func equalMemberships(a, b map[groupKey]map[uint64]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, members := range a {
+		otherMembers, ok := b[key]
+		if !ok || len(members) != len(otherMembers) {
+			return false
+		}
+		for ieee := range members {
+			if !otherMembers[ieee] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (n *Network) String() string {
+	devices, groups := n.counts()
+	return fmt.Sprintf("Network{devices=%d, groups=%d}", devices, groups)
+}
+
+// counts returns the number of devices and groups in this network.
+func (n *Network) counts() (devices int, groups int) {
+	devices = len(n.devicesSnapshot())
+	n.groupsMx.RLock()
+	groups = len(n.groups)
+	n.groupsMx.RUnlock()
+	return devices, groups
+}
+
+func sortDevices(devices []Device) {
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].NetworkAddress.Less(devices[j].NetworkAddress)
+	})
+}
+
+func sortGroups(groups []GroupAddress) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].GroupID != groups[j].GroupID {
+			return groups[i].GroupID < groups[j].GroupID
+		}
+		return groups[i].Scope < groups[j].Scope
+	})
+}
+
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.TrimSpace(label))
+}
+
+// SerializedNetwork is the serializable representation of the network state.
+type SerializedNetwork struct {
+	Devices     []Device          `json:"devices"`
+	Groups      []GroupAddress    `json:"groups"`
+	Memberships []GroupMembership `json:"memberships,omitempty"`
+	Coordinator *Device           `json:"coordinator,omitempty"`
+}
+
+// snapshot will return the serializable representation of the network state. Transient devices are skipped. Devices,
+// groups and memberships are sorted, so that saving unchanged state produces identical files.
+func (n *Network) snapshot() *SerializedNetwork {
+	// Network state is a serialization of an array of devices and groups
+	state := &SerializedNetwork{}
+	n.withReadLocks(func() {
+		for _, device := range n.devices {
+			if device.Transient {
+				continue
+			}
+			state.Devices = append(state.Devices, device)
+		}
+		for _, group := range n.groups {
+			state.Groups = append(state.Groups, group)
+		}
+		state.Memberships = n.serializedMemberships()
+		state.Coordinator = n.coordinator
+	})
+	sortDevices(state.Devices)
+	sortGroups(state.Groups)
+	return state
+}
+
+// restore will merge the serializable representation of the network state into the network.
+func (n *Network) restore(state *SerializedNetwork) {
+	n.withWriteLocks(func() {
+		n.restoreLocked(state)
+	})
+}
+
+// restoreLocked will merge the serializable representation of the network state into the network. Caller must hold
+// the devices and groups write locks.
+func (n *Network) restoreLocked(state *SerializedNetwork) {
+	n.initDevices()
+	n.initGroups()
+	for _, device := range state.Devices {
+		n.storeDevice(n.deviceKey(device), device)
+	}
+	for _, group := range state.Groups {
+		n.storeGroup(group)
+	}
+	if state.Coordinator != nil {
+		n.coordinator = state.Coordinator
+		n.markDirty()
+	}
+	for _, membership := range state.Memberships {
+		key := groupKey{scope: membership.Scope, groupID: membership.GroupID}
+		if n.memberships == nil {
+			n.memberships = make(map[groupKey]map[uint64]bool)
+		}
+		if n.memberships[key] == nil {
+			n.memberships[key] = make(map[uint64]bool)
+		}
+		for _, ieee := range membership.Members {
+			n.memberships[key][ieee] = true
+		}
+		n.markDirty()
+	}
+}
+
+// MarshalJSON will implement custom JSON serialization.
+func (n *Network) MarshalJSON() ([]byte, error) {
+	return JSONCodec.Marshal(n.snapshot())
+}
+
+// CanonicalBytes will serialize the network state in a canonical form, with devices and groups sorted, so that equal
+// network states produce identical bytes.
+func (n *Network) CanonicalBytes() ([]byte, error) {
+	return JSONCodec.Marshal(n.snapshot())
+}
+
+// MarshalDevices will serialize the network devices as a JSON array.
+func (n *Network) MarshalDevices() ([]byte, error) {
+	devices := n.snapshot().Devices
+	if devices == nil {
+		devices = []Device{}
+	}
+	return json.Marshal(devices)
+}
+
+// UnmarshalDevices will merge the devices serialized as a JSON array into the network. Devices are normalized and
+// sanitized as done by AddDevice, and the network is left unchanged if a device is rejected or if the merged devices
+// exceed the maximum number of devices.
+func (n *Network) UnmarshalDevices(data []byte) error {
+	var state SerializedNetwork
+	if err := json.Unmarshal(data, &state.Devices); err != nil {
+		return err
+	}
+	for i, device := range state.Devices {
+		device, err := n.sanitizeDevice(n.normalizeDevice(device))
+		if err != nil {
+			return err
+		}
+		state.Devices[i] = device
+	}
+	var err error
+	n.withWriteLocks(func() {
+		if err = n.checkMergeCapacity(state.Devices); err == nil {
+			n.restoreLocked(&state)
+		}
+	})
+	return err
+}
+
+// MarshalGroups will serialize the network group addresses as a JSON array.
+func (n *Network) MarshalGroups() ([]byte, error) {
+	groups := n.snapshot().Groups
+	if groups == nil {
+		groups = []GroupAddress{}
+	}
+	return json.Marshal(groups)
+}
+
+// UnmarshalGroups will merge the group addresses serialized as a JSON array into the network. Group labels are
+// sanitized as done by AddGroup, and the network is left unchanged if a group is rejected.
+func (n *Network) UnmarshalGroups(data []byte) error {
+	var state SerializedNetwork
+	if err := json.Unmarshal(data, &state.Groups); err != nil {
+		return err
+	}
+	for i, group := range state.Groups {
+		group, err := n.sanitizeGroup(group)
+		if err != nil {
+			return err
+		}
+		state.Groups[i] = group
+	}
+	n.restore(&state)
+	return nil
+}
+
+// UnmarshalJSON will implement custom JSON deserialization. Legacy state, made of a plain array of devices, is
+// supported too.
+func (n *Network) UnmarshalJSON(data []byte) error {
+	var state SerializedNetwork
+	if err := JSONCodec.Unmarshal(data, &state); err != nil {
+		return err
 	}
+	n.restore(&state)
 	return nil
 }
@@ -0,0 +1,1012 @@
+package zigbee
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestNetwork returns a reset network saving its state in a temporary directory.
+func newTestNetwork(t *testing.T, options ...NetworkOption) *Network {
+	t.Helper()
+	n := NewNetworkState(true, options...)
+	n.filePath = filepath.Join(t.TempDir(), "network.json")
+	return n
+}
+
+func TestFlushSkipsUnchangedNetwork(t *testing.T) {
+	writes := 0
+	n := newTestNetwork(t, WithSaveHook(func([]byte) { writes++ }))
+	n.AddDevice(testDevice(1, 1))
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	if !n.Dirty() {
+		t.Fatal("Expected network to be dirty after changes")
+	}
+	if err := n.Flush(); err != nil || writes != 1 {
+		t.Fatalf("Expected a single write, got %d writes and error %v", writes, err)
+	}
+
+	n.UpdateDevice(testDevice(1, 1))
+	n.RemoveDeviceByIEEE(2)
+	n.AddGroupMember(2, 1)
+	n.RemoveGroupMember(1, 1)
+	n.GetOrCreateGroup("Kitchen", func() uint32 { return 2 })
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.SetGroupMembers(1, nil)
+	if n.Dirty() {
+		t.Fatal("Expected operations leaving the network unchanged not to mark it dirty")
+	}
+	if err := n.Flush(); err != nil || writes != 1 {
+		t.Fatalf("Expected no write for unchanged network, got %d writes and error %v", writes, err)
+	}
+
+	n.AddGroupMember(1, 1)
+	if err := n.Flush(); err != nil || writes != 2 {
+		t.Fatalf("Expected a write after a change, got %d writes and error %v", writes, err)
+	}
+	if err := n.Shutdown(); err != nil || writes != 2 {
+		t.Fatalf("Expected shutdown not to write unchanged network, got %d writes and error %v", writes, err)
+	}
+}
+
+func TestStartupClearsDirty(t *testing.T) {
+	n := newTestNetwork(t)
+	n.AddDevice(testDevice(1, 1))
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewNetworkState(false)
+	loaded.filePath = n.filePath
+	if err := loaded.Startup(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Dirty() {
+		t.Fatal("Expected network loaded from file not to be dirty")
+	}
+	fresh := newTestNetwork(t)
+	if err := fresh.Startup(); err != nil {
+		t.Fatal(err)
+	}
+	if !fresh.Dirty() {
+		t.Fatal("Expected fresh network to be dirty")
+	}
+}
+
+func TestRemoveDeviceByIEEE(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddDevice(testDevice(1, 1))
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroupMember(1, 1)
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	n.AddGroupListener(listener)
+	if n.RemoveDeviceByIEEE(2) {
+		t.Fatal("Expected absent device not to be removed")
+	}
+	if !n.RemoveDeviceByIEEE(1) {
+		t.Fatal("Expected present device to be removed")
+	}
+	if _, ok := n.Device(NewDeviceAddress(1, 1)); ok {
+		t.Fatal("Expected removed device to be missing")
+	}
+	expected := []string{"member removed 1 1", "removed 1/1"}
+	if events := listener.Events(); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+}
+
+func TestAllClusters(t *testing.T) {
+	n := NewNetworkState(true)
+	first := testDevice(1, 1)
+	first.InputClusterIds = []uint32{8, 6, 0}
+	first.OutputClusterIds = []uint32{25}
+	second := testDevice(2, 2)
+	second.InputClusterIds = []uint32{6, 0x0402}
+	second.OutputClusterIds = []uint32{25, 3}
+	n.AddDevice(first)
+	n.AddDevice(second)
+	if clusters := n.AllInputClusters(); !reflect.DeepEqual(clusters, []uint32{0, 6, 8, 0x0402}) {
+		t.Fatalf("Expected sorted distinct input clusters, got %v", clusters)
+	}
+	if clusters := n.AllOutputClusters(); !reflect.DeepEqual(clusters, []uint32{3, 25}) {
+		t.Fatalf("Expected sorted distinct output clusters, got %v", clusters)
+	}
+}
+
+func TestWithoutResetSave(t *testing.T) {
+	previous := newTestNetwork(t)
+	previous.AddDevice(testDevice(1, 1))
+	if err := previous.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	reset := NewNetworkState(true, WithoutResetSave())
+	reset.filePath = previous.filePath
+	if err := reset.Startup(); err != nil {
+		t.Fatal(err)
+	}
+	reset.AddDevice(testDevice(2, 2))
+	if err := reset.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := loadNetwork(t, previous.filePath); !loaded.Equal(previous) {
+		t.Fatal("Expected the previous state file to be kept after a reset without save")
+	}
+
+	saved := NewNetworkState(true, WithoutResetSave())
+	saved.filePath = previous.filePath
+	if err := saved.Startup(); err != nil {
+		t.Fatal(err)
+	}
+	saved.AddDevice(testDevice(2, 2))
+	if err := saved.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved.AddDevice(testDevice(3, 3))
+	if err := saved.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := loadNetwork(t, previous.filePath); !loaded.Equal(saved) {
+		t.Fatal("Expected the state to be saved on shutdown after an explicit save")
+	}
+}
+
+func TestNetworkString(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	if s := n.String(); s != "Network{devices=3, groups=2}" {
+		t.Fatalf("Unexpected network string %q", s)
+	}
+}
+
+func TestOnRedundantUpdate(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddDevice(testDevice(1, 1))
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	var redundant []Device
+	n.OnRedundantUpdate(func(device Device) {
+		redundant = append(redundant, device)
+	})
+	n.UpdateDevice(testDevice(1, 1))
+	if len(redundant) != 1 || len(listener.Events()) != 0 {
+		t.Fatalf("Expected the hook only for a no-op update, got %v and events %v", redundant, listener.Events())
+	}
+	updated := testDevice(1, 1)
+	updated.Label = "lamp"
+	n.UpdateDevice(updated)
+	if len(redundant) != 1 || !reflect.DeepEqual(listener.Events(), []string{"updated 1/1"}) {
+		t.Fatalf("Expected a real update not to invoke the hook, got %v and events %v", redundant, listener.Events())
+	}
+	n.OnRedundantUpdate(nil)
+	n.UpdateDevice(updated)
+	if len(redundant) != 1 {
+		t.Fatal("Expected the removed hook not to be invoked")
+	}
+}
+
+func TestOnRedundantUpdateReadingNetwork(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddDevice(testDevice(1, 1))
+	var devices int
+	n.OnRedundantUpdate(func(device Device) {
+		devices = len(n.Devices())
+		n.RemoveDevice(device)
+	})
+	waitDone(t, func() {
+		n.UpdateDevice(testDevice(1, 1))
+	})
+	if devices != 1 || len(n.Devices()) != 0 {
+		t.Fatalf("Expected the hook to read and change the network, got %d devices", devices)
+	}
+}
+
+func TestAddGroupUniqueLabelConcurrent(t *testing.T) {
+	n := NewNetworkState(true)
+	var accepted, conflicts int32
+	var wg sync.WaitGroup
+	for i := uint32(1); i <= 16; i++ {
+		wg.Add(1)
+		go func(groupID uint32) {
+			defer wg.Done()
+			err := n.AddGroupUniqueLabel(GroupAddress{GroupID: groupID, Label: " Kitchen "})
+			switch {
+			case err == nil:
+				atomic.AddInt32(&accepted, 1)
+			case CodeOf(err) == CodeConflict:
+				atomic.AddInt32(&conflicts, 1)
+			default:
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if accepted != 1 || conflicts != 15 || len(n.Groups()) != 1 {
+		t.Fatalf("Expected a single group with the label, got %d accepted, %d conflicts and groups %v", accepted, conflicts, n.Groups())
+	}
+	if err := n.AddGroupUniqueLabel(GroupAddress{GroupID: 1, Label: "kitchen", Scope: 1}); err != nil {
+		t.Fatalf("Expected the label to be available in another scope, got %v", err)
+	}
+}
+
+// networkAddresses returns the sorted network addresses of the supplied devices.
+func networkAddresses(devices []Device) []uint32 {
+	var addresses []uint32
+	for _, device := range devices {
+		addresses = append(addresses, device.NetworkAddress.NetworkAddress)
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+	return addresses
+}
+
+func TestDevicesWithVersion(t *testing.T) {
+	n := NewNetworkState(true)
+	for i, version := range []uint32{0, 1, 2, 2, 3} {
+		device := testDevice(uint64(i+1), uint32(i+1))
+		device.DeviceVersion = version
+		n.AddDevice(device)
+	}
+	if devices := n.DevicesWithVersion(2); !reflect.DeepEqual(networkAddresses(devices), []uint32{3, 4}) {
+		t.Fatalf("Expected devices with version 2, got %v", devices)
+	}
+	if devices := n.DevicesWithVersionBelow(2); !reflect.DeepEqual(networkAddresses(devices), []uint32{1, 2}) {
+		t.Fatalf("Expected devices below version 2, got %v", devices)
+	}
+	if devices := n.DevicesWithVersionBelow(0); len(devices) != 0 {
+		t.Fatalf("Expected no device below version 0, got %v", devices)
+	}
+	if devices := n.DevicesWithVersion(4); len(devices) != 0 {
+		t.Fatalf("Expected no device with version 4, got %v", devices)
+	}
+}
+
+func TestScopedGroupsCoexist(t *testing.T) {
+	n := newTestNetwork(t)
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "garden", Scope: 2})
+	if group, ok := n.ScopedGroup(0, 1); !ok || group.Label != "kitchen" {
+		t.Fatalf("Expected the default scope group, got %v", group)
+	}
+	if group, ok := n.ScopedGroup(2, 1); !ok || group.Label != "garden" {
+		t.Fatalf("Expected the scoped group, got %v", group)
+	}
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := loadNetwork(t, n.filePath); !loaded.Equal(n) {
+		t.Fatal("Expected scoped groups to round trip")
+	}
+	n.RemoveGroup(GroupAddress{GroupID: 1, Scope: 2})
+	if _, ok := n.Group(1); !ok {
+		t.Fatal("Expected removing the scoped group to keep the default scope one")
+	}
+	if _, ok := n.ScopedGroup(2, 1); ok {
+		t.Fatal("Expected the scoped group to be removed")
+	}
+}
+
+func TestSortedDevicesAndGroups(t *testing.T) {
+	n := NewNetworkState(true)
+	for _, address := range []DeviceAddress{{NetworkAddress: 20, Endpoint: 1}, {NetworkAddress: 3, Endpoint: 2},
+		{NetworkAddress: 100, Endpoint: 0}, {NetworkAddress: 3, Endpoint: 1}} {
+		device := testDevice(uint64(address.NetworkAddress), 0)
+		device.NetworkAddress = address
+		if address.Endpoint == 0 {
+			device.InputClusterIds = nil
+		}
+		n.AddDevice(device)
+	}
+	var addresses []string
+	for _, device := range n.DevicesSorted() {
+		addresses = append(addresses, device.NetworkAddress.String())
+	}
+	if expected := []string{"3/1", "3/2", "20/1", "100/0"}; !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("Expected devices sorted as %v, got %v", expected, addresses)
+	}
+	for _, group := range []GroupAddress{{GroupID: 9}, {GroupID: 2, Scope: 1}, {GroupID: 2}, {GroupID: 1, Scope: 3}} {
+		n.AddGroup(group)
+	}
+	expected := []GroupAddress{{GroupID: 1, Scope: 3}, {GroupID: 2}, {GroupID: 2, Scope: 1}, {GroupID: 9}}
+	if groups := n.GroupsSorted(); !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("Expected groups sorted as %v, got %v", expected, groups)
+	}
+}
+
+func TestDeviceNormalizer(t *testing.T) {
+	n := NewNetworkState(true, WithDeviceNormalizer(func(device Device) Device {
+		device.Label = strings.ToUpper(device.Label)
+		device.NetworkAddress = NewDeviceAddress(99, 99)
+		return device
+	}))
+	listener := &labelListener{}
+	n.AddNetworkListener(listener)
+	device := testDevice(1, 1)
+	device.Label = "lamp"
+	n.AddDevice(device)
+	if stored, _ := n.Device(NewDeviceAddress(1, 1)); stored.Label != "LAMP" {
+		t.Fatalf("Expected the stored device to be normalized, got %v", stored)
+	}
+	device.Label = "light"
+	n.UpdateDevice(device)
+	if stored, _ := n.Device(NewDeviceAddress(1, 1)); stored.Label != "LIGHT" {
+		t.Fatalf("Expected the updated device to be normalized, got %v", stored)
+	}
+	if !reflect.DeepEqual(listener.labels, []string{"LIGHT"}) {
+		t.Fatalf("Expected the notified device to be normalized, got %v", listener.labels)
+	}
+	if _, ok := n.Device(NewDeviceAddress(99, 99)); ok {
+		t.Fatal("Expected the normalizer not to change the network address")
+	}
+}
+
+func TestRemoveDevicesWhere(t *testing.T) {
+	n := NewNetworkState(true)
+	for i := uint32(1); i <= 4; i++ {
+		device := testDevice(uint64(i), i)
+		device.DeviceVersion = i % 2
+		n.AddDevice(device)
+	}
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroupMember(1, 1)
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	removed := n.RemoveDevicesWhere(func(device Device) bool {
+		return device.DeviceVersion == 1
+	})
+	if removed != 2 || !reflect.DeepEqual(networkAddresses(n.Devices()), []uint32{2, 4}) {
+		t.Fatalf("Expected only matching devices to be removed, got %d removed and devices %v", removed, n.Devices())
+	}
+	events := listener.Events()
+	sort.Strings(events)
+	if !reflect.DeepEqual(events, []string{"removed 1/1", "removed 3/1"}) {
+		t.Fatalf("Expected removal events for matching devices, got %v", events)
+	}
+	if members := n.GroupMembers(1); len(members) != 0 {
+		t.Fatalf("Expected memberships of removed devices to be removed, got %v", members)
+	}
+	if removed := n.RemoveDevicesWhere(func(Device) bool { return false }); removed != 0 || len(listener.Events()) != 2 {
+		t.Fatalf("Expected nothing removed without matches, got %d", removed)
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	if problems := n.CheckIntegrity(); len(problems) != 0 {
+		t.Fatalf("Expected a healthy network, got %v", problems)
+	}
+	zero := testDevice(0, 10)
+	invalid := testDevice(11, 11)
+	invalid.InputClusterIds = nil
+	collision := testDevice(1, 12)
+	n.devices[n.deviceKey(zero)] = zero
+	n.devices[n.deviceKey(invalid)] = invalid
+	n.devices[n.deviceKey(collision)] = collision
+	n.memberships[groupKey{groupID: 1}][0x99] = true
+	var messages []string
+	for _, problem := range n.CheckIntegrity() {
+		if code := CodeOf(problem); code != CodeIntegrity && code != CodeInvalid {
+			t.Errorf("Unexpected code of problem %v", problem)
+		}
+		messages = append(messages, problem.Error())
+	}
+	sort.Strings(messages)
+	expected := []string{
+		"Device 10/1 has a zero IEEE address",
+		"Device 11/1 has no clusters",
+		"Group 1 has member 99 with no device",
+		"IEEE address 1 is used by network addresses 1, 12",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Fatalf("Expected problems %v, got %v", expected, messages)
+	}
+}
+
+func TestMaxDevices(t *testing.T) {
+	n := NewNetworkState(true, WithMaxDevices(3))
+	for i := uint32(1); i <= 3; i++ {
+		if err := n.AddDeviceChecked(testDevice(uint64(i), i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := n.AddDeviceChecked(testDevice(4, 4)); CodeOf(err) != CodeCapacity {
+		t.Fatalf("Expected a capacity error over the maximum, got %v", err)
+	}
+	n.AddDevice(testDevice(4, 4))
+	if _, ok := n.Device(NewDeviceAddress(4, 1)); ok {
+		t.Fatal("Expected the device over the maximum not to be added")
+	}
+	updated := testDevice(1, 1)
+	updated.Label = "lamp"
+	if err := n.AddDeviceChecked(updated); err != nil {
+		t.Fatalf("Expected existing devices to be replaced at the maximum, got %v", err)
+	}
+	n.RemoveDeviceByIEEE(3)
+	if err := n.AddDeviceChecked(testDevice(4, 4)); err != nil {
+		t.Fatalf("Expected a device to be added after a removal, got %v", err)
+	}
+}
+
+func TestSetDeviceLabel(t *testing.T) {
+	n := NewNetworkState(true)
+	device := testDevice(1, 1)
+	device.DeviceVersion = 3
+	device.Metadata = map[string]string{"room": "kitchen"}
+	n.AddDevice(device)
+	listener := &labelListener{}
+	n.AddNetworkListener(listener)
+	if n.SetDeviceLabel(2, "lamp") {
+		t.Fatal("Expected missing device not to be renamed")
+	}
+	if !n.SetDeviceLabel(1, "lamp") {
+		t.Fatal("Expected existing device to be renamed")
+	}
+	renamed, _ := n.Device(NewDeviceAddress(1, 1))
+	device.Label = "lamp"
+	if !renamed.Equal(device) {
+		t.Fatalf("Expected only the label to change, got %v", renamed)
+	}
+	if !reflect.DeepEqual(listener.labels, []string{"lamp"}) {
+		t.Fatalf("Expected a single update with the new label, got %v", listener.labels)
+	}
+}
+
+// reversedNetwork returns a network with the same content as populateNetwork, inserted in reverse order.
+func reversedNetwork() *Network {
+	n := NewNetworkState(true)
+	n.AddGroup(GroupAddress{GroupID: 2, Label: "garden"})
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	for i := uint32(3); i >= 1; i-- {
+		device := testDevice(uint64(i), i)
+		device.Label = "device"
+		n.AddDevice(device)
+	}
+	n.AddGroupMember(2, 3)
+	n.AddGroupMember(1, 2)
+	n.AddGroupMember(1, 1)
+	return n
+}
+
+func TestCanonicalBytes(t *testing.T) {
+	first := NewNetworkState(true)
+	populateNetwork(first)
+	second := reversedNetwork()
+	firstBytes, err := first.CanonicalBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondBytes, err := second.CanonicalBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(firstBytes, secondBytes) {
+		t.Fatalf("Expected equal canonical bytes, got %s and %s", firstBytes, secondBytes)
+	}
+	second.SetDeviceLabel(1, "lamp")
+	if secondBytes, _ = second.CanonicalBytes(); bytes.Equal(firstBytes, secondBytes) {
+		t.Fatal("Expected different networks to have different canonical bytes")
+	}
+}
+
+func TestZeroValueNetwork(t *testing.T) {
+	var n Network
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	n.AddGroupListener(listener)
+	n.AddDevice(testDevice(1, 1))
+	updated := testDevice(1, 1)
+	updated.Label = "lamp"
+	n.UpdateDevice(updated)
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroupMember(1, 1)
+	n.RemoveDevice(updated)
+	n.RemoveGroup(GroupAddress{GroupID: 1})
+	expected := []string{"added 1/1", "updated 1/1", "group added 1", "member added 1 1", "member removed 1 1",
+		"removed 1/1", "group removed 1"}
+	if events := listener.Events(); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+	if len(n.Devices()) != 0 || len(n.Groups()) != 0 {
+		t.Fatalf("Expected an empty network, got %v", n.String())
+	}
+}
+
+func TestDevicesByClusters(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddDevice(Device{IEEEAddress: 1, NetworkAddress: NewZDOAddress(1)})
+	n.AddDevice(testDevice(2, 2))
+	outputOnly := testDevice(3, 3)
+	outputOnly.InputClusterIds = nil
+	outputOnly.OutputClusterIds = []uint32{OnOffCluster}
+	n.AddDevice(outputOnly)
+	many := testDevice(4, 4)
+	many.InputClusterIds = []uint32{0, 3, 4, 5, OnOffCluster}
+	many.OutputClusterIds = []uint32{25}
+	n.AddDevice(many)
+	if devices := n.DevicesWithoutInputClusters(); !reflect.DeepEqual(networkAddresses(devices), []uint32{1, 3}) {
+		t.Fatalf("Expected devices without input clusters, got %v", devices)
+	}
+	for _, test := range []struct {
+		min, max int
+		expected []uint32
+	}{
+		{0, 0, []uint32{1}},
+		{1, 1, []uint32{2, 3}},
+		{2, 100, []uint32{4}},
+		{0, 100, []uint32{1, 2, 3, 4}},
+	} {
+		if devices := n.DevicesByClusterCount(test.min, test.max); !reflect.DeepEqual(networkAddresses(devices), test.expected) {
+			t.Errorf("Expected devices %v with %d to %d clusters, got %v", test.expected, test.min, test.max, devices)
+		}
+	}
+}
+
+func TestTouchAndStaleDevices(t *testing.T) {
+	n := newTestNetwork(t)
+	populateNetwork(n)
+	before := time.Now()
+	if n.Touch(4) {
+		t.Fatal("Expected missing device not to be touched")
+	}
+	if !n.Touch(1) {
+		t.Fatal("Expected existing device to be touched")
+	}
+	touched, _ := n.Device(NewDeviceAddress(1, 1))
+	if touched.LastSeen.Before(before) {
+		t.Fatalf("Expected last seen time to be updated, got %v", touched.LastSeen)
+	}
+	if stale := n.DevicesNotSeenSince(before); !reflect.DeepEqual(networkAddresses(stale), []uint32{2, 3}) {
+		t.Fatalf("Expected untouched devices to be stale, got %v", stale)
+	}
+	if stale := n.DevicesNotSeenSince(time.Now().Add(time.Second)); len(stale) != 3 {
+		t.Fatalf("Expected all devices to be stale later, got %v", stale)
+	}
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := loadNetwork(t, n.filePath)
+	if device, _ := loaded.Device(NewDeviceAddress(1, 1)); !device.LastSeen.Equal(touched.LastSeen) {
+		t.Fatalf("Expected last seen time to be saved, got %v", device.LastSeen)
+	}
+}
+
+func TestClusterValidation(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	n := NewNetworkState(true, WithClusterValidation(OnOffCluster, LevelControlCluster))
+
+	valid := testDevice(1, 1)
+	valid.OutputClusterIds = []uint32{LevelControlCluster}
+	if err := n.AddDeviceChecked(valid); err != nil || output.Len() != 0 {
+		t.Fatalf("Expected known clusters to be accepted silently, got %v and %q", err, output.String())
+	}
+	outOfRange := testDevice(2, 2)
+	outOfRange.InputClusterIds = []uint32{0x10000}
+	if err := n.AddDeviceChecked(outOfRange); CodeOf(err) != CodeInvalid {
+		t.Fatalf("Expected out of range cluster to be rejected, got %v", err)
+	}
+	unknown := testDevice(3, 3)
+	unknown.InputClusterIds = []uint32{0xFC00}
+	if err := n.AddDeviceChecked(unknown); err != nil {
+		t.Fatalf("Expected unknown but valid cluster to be accepted, got %v", err)
+	}
+	if !strings.Contains(output.String(), "unknown cluster id 0xfc00") {
+		t.Fatalf("Expected a warning for the unknown cluster, got %q", output.String())
+	}
+}
+
+func TestDevicesSnapshotRepublishedOnlyOnChange(t *testing.T) {
+	n := NewNetworkState(true, WithMaxDevices(1))
+	n.AddDevice(testDevice(1, 1))
+	published := reflect.ValueOf(n.devicesSnapshot()).Pointer()
+
+	n.UpdateDevice(testDevice(1, 1))
+	n.RemoveDeviceByIEEE(2)
+	n.AddDevice(testDevice(2, 2))
+	n.SetCoordinator(testDevice(3, 0))
+	if reflect.ValueOf(n.devicesSnapshot()).Pointer() != published {
+		t.Fatal("Expected unchanged devices to keep the published snapshot")
+	}
+
+	n.SetDeviceLabel(1, "lamp")
+	if reflect.ValueOf(n.devicesSnapshot()).Pointer() == published {
+		t.Fatal("Expected changed devices to publish a new snapshot")
+	}
+	if device, _ := n.Device(NewDeviceAddress(1, 1)); device.Label != "lamp" {
+		t.Fatalf("Expected the updated device to be read, got %v", device)
+	}
+}
+
+func TestGetOrCreateGroup(t *testing.T) {
+	n := NewNetworkState(true)
+	listener := &recordingListener{}
+	n.AddGroupListener(listener)
+	created := n.GetOrCreateGroup("Kitchen", func() uint32 { return 1 })
+	if created.GroupID != 1 || created.Label != "Kitchen" {
+		t.Fatalf("Expected group 1 to be created, got %v", created)
+	}
+	existing := n.GetOrCreateGroup(" kitchen ", func() uint32 {
+		t.Fatal("Expected no new id for an existing group")
+		return 0
+	})
+	if existing != created {
+		t.Fatalf("Expected existing group %v, got %v", created, existing)
+	}
+	if taken := n.GetOrCreateGroup("Garden", func() uint32 { return 1 }); taken != (GroupAddress{}) {
+		t.Fatalf("Expected a taken id to be rejected, got %v", taken)
+	}
+	if invalid := n.GetOrCreateGroup("Garden", func() uint32 { return MaxGroupID + 1 }); invalid != (GroupAddress{}) {
+		t.Fatalf("Expected an invalid id to be rejected, got %v", invalid)
+	}
+	if group, _ := n.Group(1); group.Label != "Kitchen" {
+		t.Fatalf("Expected the existing group to be kept, got %v", group)
+	}
+	if events := listener.Events(); !reflect.DeepEqual(events, []string{"group added 1"}) {
+		t.Fatalf("Expected a single group added event, got %v", events)
+	}
+}
+
+func TestGetOrCreateGroupConcurrentCallers(t *testing.T) {
+	n := NewNetworkState(true)
+	listener := &recordingListener{}
+	n.AddGroupListener(listener)
+	var ids uint32
+	newID := func() uint32 { return atomic.AddUint32(&ids, 1) }
+	groups := make([]GroupAddress, 16)
+	var wg sync.WaitGroup
+	for i := range groups {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			groups[i] = n.GetOrCreateGroup("Kitchen", newID)
+		}(i)
+	}
+	wg.Wait()
+	for _, group := range groups {
+		if group != groups[0] || group.GroupID == 0 {
+			t.Fatalf("Expected all callers to get the same group, got %v", groups)
+		}
+	}
+	if events := listener.Events(); len(events) != 1 {
+		t.Fatalf("Expected a single group creation, got events %v", events)
+	}
+}
+
+func TestGetOrCreateGroupReadingNewID(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	newID := func() uint32 {
+		id := uint32(1)
+		for n.GroupExists(id) {
+			id++
+		}
+		return id
+	}
+	var group GroupAddress
+	waitDone(t, func() {
+		group = n.GetOrCreateGroup("Garden", newID)
+	})
+	if group.GroupID != 2 || len(n.Groups()) != 2 {
+		t.Fatalf("Expected group 2 to be created, got %v", group)
+	}
+}
+
+func TestReplaceDevices(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddDevice(testDevice(1, 1))
+	n.AddDevice(testDevice(2, 2))
+	n.AddDevice(testDevice(3, 3))
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	updated := testDevice(2, 2)
+	updated.Label = "lamp"
+	n.ReplaceDevices([]Device{testDevice(1, 1), updated, testDevice(4, 4)})
+	expected := []string{"added 4/1", "updated 2/1", "removed 3/1"}
+	if events := listener.Events(); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+	if devices, _ := n.counts(); devices != 3 {
+		t.Fatalf("Expected 3 devices, got %d", devices)
+	}
+}
+
+func TestReplaceDevicesEnforcesMaxDevices(t *testing.T) {
+	n := NewNetworkState(true, WithMaxDevices(2))
+	n.AddDevice(testDevice(1, 1))
+	n.ReplaceDevices([]Device{testDevice(2, 2), testDevice(3, 3), testDevice(4, 4)})
+	if _, ok := n.Device(NewDeviceAddress(1, 1)); !ok {
+		t.Fatal("Expected devices over the maximum to leave the network unchanged")
+	}
+	n.ReplaceDevices([]Device{testDevice(2, 2), testDevice(3, 3)})
+	if devices, _ := n.counts(); devices != 2 {
+		t.Fatalf("Expected devices within the maximum to be replaced, got %d devices", devices)
+	}
+}
+
+func TestReplaceDevicesNormalizesBeforeSanitizing(t *testing.T) {
+	calls := 0
+	n := NewNetworkState(true, WithLabelPolicy(RejectInvalidLabels), WithDeviceNormalizer(func(d Device) Device {
+		calls++
+		d.Label = string([]byte{0xff})
+		return d
+	}))
+	n.AddDevice(testDevice(1, 1))
+	n.ReplaceDevices([]Device{testDevice(2, 2)})
+	if devices, _ := n.counts(); devices != 0 || calls != 2 {
+		t.Fatalf("Expected normalized devices to be sanitized, got %d devices and %d normalizer calls", devices, calls)
+	}
+}
+
+// benchmarkDeviceReads measures concurrent Device lookups, using the supplied read function, while a writer keeps
+// updating the network. Run it with -race to check the lock free reads.
+func benchmarkDeviceReads(b *testing.B, read func(n *Network, address DeviceAddress) (Device, bool)) {
+	n := NewNetworkState(true)
+	for i := uint32(0); i < 1000; i++ {
+		n.AddDevice(testDevice(uint64(i+1), i))
+	}
+	var stop int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; atomic.LoadInt32(&stop) == 0; i++ {
+			n.SetDeviceVersion(uint64(i%1000+1), uint32(i))
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i uint32
+		for pb.Next() {
+			read(n, NewDeviceAddress(i%1000, 1))
+			i++
+		}
+	})
+	b.StopTimer()
+	atomic.StoreInt32(&stop, 1)
+	<-done
+}
+
+func BenchmarkDeviceReadsSnapshot(b *testing.B) {
+	benchmarkDeviceReads(b, func(n *Network, address DeviceAddress) (Device, bool) {
+		return n.Device(address)
+	})
+}
+
+// BenchmarkDeviceReadsLocked reads devices holding the devices read lock, as before the copy-on-write snapshot.
+func BenchmarkDeviceReadsLocked(b *testing.B) {
+	benchmarkDeviceReads(b, func(n *Network, address DeviceAddress) (Device, bool) {
+		n.devicesMx.RLock()
+		defer n.devicesMx.RUnlock()
+		device, ok := n.devices[address.String()]
+		return device, ok
+	})
+}
+
+func TestListenerCounts(t *testing.T) {
+	n := NewNetworkState(true)
+	first, second, observer := &recordingListener{}, &recordingListener{}, &observingListener{}
+	n.AddNetworkListener(first)
+	handle := n.AddNetworkListener(second)
+	n.AddCommandListener(observer)
+	if n.ListenerCount() != 2 || n.CommandListenerCount() != 1 {
+		t.Fatalf("Expected 2 network and 1 command listeners, got %d and %d", n.ListenerCount(), n.CommandListenerCount())
+	}
+	n.RemoveNetworkListener(first)
+	n.RemoveNetworkListenerHandle(handle)
+	n.RemoveCommandListener(observer)
+	n.RemoveCommandListener(observer)
+	if n.ListenerCount() != 0 || n.CommandListenerCount() != 0 {
+		t.Fatalf("Expected no listeners after removal, got %d and %d", n.ListenerCount(), n.CommandListenerCount())
+	}
+}
+
+func TestReplaceGroups(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroup(GroupAddress{GroupID: 2, Label: "garden"})
+	n.AddGroup(GroupAddress{GroupID: 3, Label: "bedroom"})
+	n.AddGroupMember(2, 1)
+	listener := &recordingListener{}
+	n.AddGroupListener(listener)
+	n.ReplaceGroups([]GroupAddress{
+		{GroupID: 1, Label: "kitchen"},
+		{GroupID: 3, Label: "office"},
+		{GroupID: 4, Label: "hall"},
+	})
+	events := listener.Events()
+	sort.Strings(events)
+	expected := []string{"group added 4", "group removed 2", "group updated 3"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+	groups := n.GroupsSorted()
+	if len(groups) != 3 || groups[1].Label != "office" || groups[2].GroupID != 4 {
+		t.Fatalf("Expected groups to be replaced, got %v", groups)
+	}
+	if members := n.GroupMembers(2); len(members) != 0 {
+		t.Fatalf("Expected memberships of removed groups to be removed, got %v", members)
+	}
+}
+
+func TestDevicesAndGroupsExport(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	devices, err := n.MarshalDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := n.MarshalGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := NewNetworkState(true)
+	if err := imported.UnmarshalDevices(devices); err != nil {
+		t.Fatal(err)
+	}
+	expected := n.DevicesSorted()
+	for i, device := range imported.DevicesSorted() {
+		if !device.Equal(expected[i]) {
+			t.Fatalf("Expected device %v to be imported, got %v", expected[i], device)
+		}
+	}
+	if len(imported.Devices()) != len(expected) || len(imported.Groups()) != 0 {
+		t.Fatalf("Expected only devices to be imported, got %v", imported)
+	}
+	if err := imported.UnmarshalGroups(groups); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(imported.GroupsSorted(), n.GroupsSorted()) || len(imported.Devices()) != 3 {
+		t.Fatalf("Expected groups to be merged with the imported devices, got %v", imported)
+	}
+	empty := NewNetworkState(true)
+	if data, _ := empty.MarshalDevices(); string(data) != "[]" {
+		t.Fatalf("Expected no devices to be exported as an empty array, got %s", data)
+	}
+	if data, _ := empty.MarshalGroups(); string(data) != "[]" {
+		t.Fatalf("Expected no groups to be exported as an empty array, got %s", data)
+	}
+	if err := empty.UnmarshalDevices([]byte("{")); err == nil {
+		t.Fatal("Expected malformed devices to be rejected")
+	}
+}
+
+func TestDevicesImportChecks(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	devices, err := n.MarshalDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalized := NewNetworkState(true, WithDeviceNormalizer(func(device Device) Device {
+		device.Label = strings.ToUpper(device.Label)
+		return device
+	}))
+	if err := normalized.UnmarshalDevices(devices); err != nil {
+		t.Fatal(err)
+	}
+	if device, _ := normalized.Device(NewDeviceAddress(1, 1)); device.Label != "DEVICE" {
+		t.Fatalf("Expected imported devices to be normalized, got %q", device.Label)
+	}
+	full := NewNetworkState(true, WithMaxDevices(2))
+	full.AddDevice(testDevice(1, 1))
+	if err := full.UnmarshalDevices(devices); CodeOf(err) != CodeCapacity {
+		t.Fatalf("Expected an import exceeding the maximum number of devices to be rejected, got %v", err)
+	}
+	if count := len(full.Devices()); count != 1 {
+		t.Fatalf("Expected a rejected import to leave the network unchanged, got %d devices", count)
+	}
+}
+
+func TestConcurrentMarshalAndMutation(t *testing.T) {
+	n := newTestNetwork(t)
+	populateNetwork(n)
+	waitDone(t, func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					ieee := uint64(i*100 + j + 10)
+					n.AddDevice(testDevice(ieee, uint32(ieee)))
+					n.AddGroup(GroupAddress{GroupID: uint32(ieee), Label: "group"})
+					n.AddGroupMember(uint32(ieee), ieee)
+					n.PruneOrphanedMemberships()
+					n.RemoveDeviceByIEEE(ieee)
+				}
+			}(i)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					if _, err := n.MarshalJSON(); err != nil {
+						t.Error(err)
+					}
+					n.OrphanedMemberships()
+					n.DevicesWithGroups()
+					if err := n.Save(); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestNetworkEqual(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	if !n.Equal(reversedNetwork()) || !reversedNetwork().Equal(n) || !n.Equal(n) || n.Equal(nil) {
+		t.Fatal("Expected networks with the same content to be equal regardless of insertion order")
+	}
+	for _, mutate := range []func(*Network){
+		func(other *Network) { other.AddDevice(testDevice(4, 4)) },
+		func(other *Network) { other.RemoveDeviceByIEEE(3) },
+		func(other *Network) { other.SetDeviceLabel(1, "lamp") },
+		func(other *Network) { other.AddGroup(GroupAddress{GroupID: 3, Label: "office"}) },
+		func(other *Network) { other.UpdateGroup(GroupAddress{GroupID: 1, Label: "dining"}) },
+		func(other *Network) { other.AddGroupMember(2, 1) },
+	} {
+		other := reversedNetwork()
+		mutate(other)
+		if n.Equal(other) || other.Equal(n) {
+			t.Fatalf("Expected networks differing by one change not to be equal, got %v", other)
+		}
+	}
+}
+
+func TestZDOAndApplicationDevices(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddDevice(Device{IEEEAddress: 1, NetworkAddress: NewZDOAddress(1)})
+	n.AddDevice(testDevice(1, 1))
+	n.AddDevice(testDevice(2, 2))
+	reserved := testDevice(3, 3)
+	reserved.NetworkAddress = NewDeviceAddress(3, 242)
+	n.AddDevice(reserved)
+	zdo, application := n.ZDODevices(), n.ApplicationDevices()
+	if len(zdo)+len(application) != len(n.Devices()) {
+		t.Fatalf("Expected ZDO and application devices to partition the network, got %v and %v", zdo, application)
+	}
+	sort.Slice(zdo, func(i, j int) bool { return zdo[i].NetworkAddress.Less(zdo[j].NetworkAddress) })
+	if len(zdo) != 2 || zdo[0].NetworkAddress != NewZDOAddress(1) || zdo[1].NetworkAddress != reserved.NetworkAddress {
+		t.Fatalf("Expected ZDO and reserved endpoints, got %v", zdo)
+	}
+	if addresses := networkAddresses(application); !reflect.DeepEqual(addresses, []uint32{1, 2}) {
+		t.Fatalf("Expected application endpoints, got %v", addresses)
+	}
+}
+
+func TestGroupAndDeviceExists(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	if !n.GroupExists(1) || n.GroupExists(3) {
+		t.Fatal("Expected only existing groups to exist")
+	}
+	for _, test := range []struct {
+		address Address
+		exists  bool
+	}{
+		{NewDeviceAddress(1, 1), true},
+		{NewDeviceAddress(1, 2), false},
+		{NewDeviceAddress(4, 1), false},
+		{GroupAddress{GroupID: 1, Label: "kitchen"}, false},
+		{NewDeviceAddress(BroadcastAllDevices, 1), false},
+	} {
+		if exists := n.DeviceExists(test.address); exists != test.exists {
+			t.Errorf("Expected device %s existence to be %t, got %t", test.address, test.exists, exists)
+		}
+	}
+	n.RemoveGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.RemoveDeviceByIEEE(1)
+	if n.GroupExists(1) || n.DeviceExists(NewDeviceAddress(1, 1)) {
+		t.Fatal("Expected removed groups and devices not to exist")
+	}
+}
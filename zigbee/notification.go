@@ -0,0 +1,284 @@
+package zigbee
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// notifyListeners will invoke the supplied function for each registered network listener.
+func (n *Network) notifyListeners(fn func(NetworkListener)) {
+	n.notify(func() {
+		n.dispatchListeners(fn)
+	})
+}
+
+// queueListeners will invoke the supplied function for each registered network listener once the devices write lock
+// is released. Caller must hold the devices write lock.
+func (n *Network) queueListeners(fn func(NetworkListener)) {
+	n.queueDevicesDispatch(func() {
+		n.dispatchListeners(fn)
+	})
+}
+
+// queueGroupListeners will invoke the supplied function for each registered group listener once the groups write
+// lock is released. Caller must hold the groups write lock.
+func (n *Network) queueGroupListeners(fn func(GroupListener)) {
+	n.queueGroupsDispatch(func() {
+		n.dispatchGroupListeners(fn)
+	})
+}
+
+// queueDevicesDispatch will queue the supplied dispatch function, run once the devices write lock is released so
+// that listeners can read the network. Caller must hold the devices write lock.
+func (n *Network) queueDevicesDispatch(dispatch func()) {
+	n.deviceDispatches = append(n.deviceDispatches, dispatch)
+}
+
+// queueGroupsDispatch will queue the supplied dispatch function, run once the groups write lock is released so that
+// listeners can read the network. Caller must hold the groups write lock.
+func (n *Network) queueGroupsDispatch(dispatch func()) {
+	n.groupDispatches = append(n.groupDispatches, dispatch)
+}
+
+// unlockNotifying will release the supplied lock and then run the queued dispatch functions as a single
+// notification. The notification is reserved before releasing the lock, so that ordered notifications follow the
+// commit order. Asynchronous notifications are queued before releasing the lock, since queueing never blocks.
+func (n *Network) unlockNotifying(mx sync.Locker, dispatches []func()) {
+	if len(dispatches) == 0 {
+		mx.Unlock()
+		return
+	}
+	dispatch := func() {
+		for _, dispatch := range dispatches {
+			dispatch()
+		}
+	}
+	if n.events != nil && !n.orderedNotifications {
+		n.deliver(dispatch)
+		mx.Unlock()
+		return
+	}
+	ticket := n.reserveNotification()
+	mx.Unlock()
+	n.notifyReserved(ticket, dispatch)
+}
+
+// notify will run the supplied dispatch function. When asynchronous notifications are enabled
+// the dispatch is queued, and it's dropped if the queue is full.
+func (n *Network) notify(dispatch func()) {
+	n.notifyReserved(n.reserveNotification(), dispatch)
+}
+
+// reserveNotification returns the ticket ordering a notification when ordered notifications are enabled, or zero
+// otherwise. It must be called while holding the lock of the committed change, and the ticket must always be passed
+// to notifyReserved.
+func (n *Network) reserveNotification() uint64 {
+	if !n.orderedNotifications {
+		return 0
+	}
+	n.orderMx.Lock()
+	defer n.orderMx.Unlock()
+	n.reservedNotifications++
+	return n.reservedNotifications
+}
+
+// notifyReserved will run the supplied dispatch function once all the notifications with a lower ticket have been
+// run. A zero ticket runs the dispatch function immediately.
+func (n *Network) notifyReserved(ticket uint64, dispatch func()) {
+	if ticket == 0 {
+		n.deliver(dispatch)
+		return
+	}
+	n.orderMx.Lock()
+	if n.orderCond == nil {
+		n.orderCond = sync.NewCond(&n.orderMx)
+	}
+	for n.deliveredNotifications+1 != ticket {
+		n.orderCond.Wait()
+	}
+	n.orderMx.Unlock()
+	defer func() {
+		n.orderMx.Lock()
+		n.deliveredNotifications = ticket
+		n.orderCond.Broadcast()
+		n.orderMx.Unlock()
+	}()
+	n.deliver(dispatch)
+}
+
+// deliver will run the supplied dispatch function, or queue it when asynchronous notifications are enabled. Queued
+// notifications are dropped once the network is shut down.
+func (n *Network) deliver(dispatch func()) {
+	if n.events == nil {
+		dispatch()
+		return
+	}
+	select {
+	case <-n.eventsDone:
+		atomic.AddUint64(&n.droppedEvents, 1)
+		return
+	default:
+	}
+	select {
+	case n.events <- dispatch:
+	default:
+		atomic.AddUint64(&n.droppedEvents, 1)
+	}
+}
+
+// dispatchListeners will synchronously invoke the supplied function for each registered network listener.
+func (n *Network) dispatchListeners(fn func(NetworkListener)) {
+	n.listenersMx.RLock()
+	defer n.listenersMx.RUnlock()
+	for i := range n.listeners {
+		registration := n.listeners[n.listenerIndex(i, len(n.listeners))]
+		if registration.listener != nil && !registration.replaying {
+			fn(registration.listener)
+		}
+	}
+}
+
+// dispatchGroupListeners will synchronously invoke the supplied function for each registered group listener.
+func (n *Network) dispatchGroupListeners(fn func(GroupListener)) {
+	n.listenersMx.RLock()
+	defer n.listenersMx.RUnlock()
+	for i := range n.groupListeners {
+		if listener := n.groupListeners[n.listenerIndex(i, len(n.groupListeners))]; listener != nil {
+			fn(listener)
+		}
+	}
+}
+
+// listenerIndex returns the index of the i-th listener to notify out of count, according to the listener order.
+func (n *Network) listenerIndex(i, count int) int {
+	if n.listenerOrder == LIFO {
+		return count - 1 - i
+	}
+	return i
+}
+
+// processEvents will serially dispatch queued notifications until the network is shut down, delivering the
+// notifications still queued at shutdown before returning.
+func (n *Network) processEvents() {
+	defer close(n.eventsStopped)
+	for {
+		select {
+		case dispatch := <-n.events:
+			dispatch()
+		case <-n.eventsDone:
+			for {
+				select {
+				case dispatch := <-n.events:
+					dispatch()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// stopEvents will stop the asynchronous notification processing, if enabled, waiting for the queued notifications
+// to be delivered.
+func (n *Network) stopEvents() {
+	if n.eventsDone == nil {
+		return
+	}
+	n.eventsOnce.Do(func() {
+		close(n.eventsDone)
+	})
+	<-n.eventsStopped
+}
+
+// DroppedNotifications returns the number of notifications dropped because the
+// asynchronous notification queue was full, or because the network was shut down.
+func (n *Network) DroppedNotifications() uint64 {
+	return atomic.LoadUint64(&n.droppedEvents)
+}
+
+// queueDeviceUpdated will notify listeners of the device update once the devices write lock is released. When update
+// debounce is enabled, the notification is delayed and coalesced with the following updates of the same device
+// within the debounce window. Caller must hold the devices write lock.
+func (n *Network) queueDeviceUpdated(device Device) {
+	if n.updateDebounce <= 0 {
+		n.queueListeners(func(listener NetworkListener) {
+			listener.DeviceUpdated(device)
+		})
+		return
+	}
+	n.debounceMx.Lock()
+	defer n.debounceMx.Unlock()
+	if n.debounced == nil {
+		n.debounced = make(map[string]*debouncedUpdate)
+	}
+	key := n.deviceKey(device)
+	if pending, ok := n.debounced[key]; ok {
+		pending.device = device
+		return
+	}
+	pending := &debouncedUpdate{device: device}
+	pending.timer = time.AfterFunc(n.updateDebounce, func() {
+		n.flushDebouncedUpdate(key, pending)
+	})
+	n.debounced[key] = pending
+}
+
+// queueDeviceRemoved will notify listeners of the device removal once the devices write lock is released,
+// discarding any pending debounced update. Caller must hold the devices write lock.
+func (n *Network) queueDeviceRemoved(device Device) {
+	n.cancelDebouncedUpdate(device)
+	n.queueListeners(func(listener NetworkListener) {
+		listener.DeviceRemoved(device)
+	})
+}
+
+// cancelDebouncedUpdate will discard the pending debounced update of the supplied device.
+func (n *Network) cancelDebouncedUpdate(device Device) {
+	if n.updateDebounce <= 0 {
+		return
+	}
+	n.debounceMx.Lock()
+	defer n.debounceMx.Unlock()
+	key := n.deviceKey(device)
+	if pending, ok := n.debounced[key]; ok {
+		pending.timer.Stop()
+		delete(n.debounced, key)
+	}
+}
+
+// debouncedUpdate is a device update notification waiting for the debounce window to expire.
+type debouncedUpdate struct {
+	device Device
+	timer  *time.Timer
+}
+
+// flushDebouncedUpdate will notify listeners of the latest state of a debounced update.
+func (n *Network) flushDebouncedUpdate(key string, pending *debouncedUpdate) {
+	n.debounceMx.Lock()
+	if n.debounced[key] != pending {
+		n.debounceMx.Unlock()
+		return
+	}
+	delete(n.debounced, key)
+	device := pending.device
+	n.debounceMx.Unlock()
+	n.notifyListeners(func(listener NetworkListener) {
+		listener.DeviceUpdated(device)
+	})
+}
+
+// flushDebouncedUpdates will immediately notify listeners of all pending debounced updates.
+func (n *Network) flushDebouncedUpdates() {
+	n.debounceMx.Lock()
+	pending := n.debounced
+	n.debounced = nil
+	n.debounceMx.Unlock()
+	for _, update := range pending {
+		update.timer.Stop()
+		device := update.device
+		n.notifyListeners(func(listener NetworkListener) {
+			listener.DeviceUpdated(device)
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package zigbee
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingListener records the notified events as strings, in the order they are received.
+type recordingListener struct {
+	mx     sync.Mutex
+	events []string
+}
+
+func (l *recordingListener) record(format string, args ...interface{}) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.events = append(l.events, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingListener) Events() []string {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+func (l *recordingListener) DeviceAdded(d Device)   { l.record("added %s", d.NetworkAddress) }
+func (l *recordingListener) DeviceUpdated(d Device) { l.record("updated %s", d.NetworkAddress) }
+func (l *recordingListener) DeviceRemoved(d Device) { l.record("removed %s", d.NetworkAddress) }
+
+func (l *recordingListener) GroupAdded(g GroupAddress)   { l.record("group added %d", g.GroupID) }
+func (l *recordingListener) GroupUpdated(g GroupAddress) { l.record("group updated %d", g.GroupID) }
+func (l *recordingListener) GroupRemoved(g GroupAddress) { l.record("group removed %d", g.GroupID) }
+
+func (l *recordingListener) GroupMemberAdded(g GroupAddress, ieee uint64) {
+	l.record("member added %d %x", g.GroupID, ieee)
+}
+
+func (l *recordingListener) GroupMemberRemoved(g GroupAddress, ieee uint64) {
+	l.record("member removed %d %x", g.GroupID, ieee)
+}
+
+// testDevice returns a valid application device with supplied IEEE and network address.
+func testDevice(ieee uint64, address uint32) Device {
+	return Device{
+		IEEEAddress:     ieee,
+		NetworkAddress:  NewDeviceAddress(address, 1),
+		InputClusterIds: []uint32{OnOffCluster},
+	}
+}
+
+// waitDone fails the test if fn doesn't complete within a few seconds, as happens on deadlocks.
+func waitDone(t *testing.T, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out, possible deadlock")
+	}
+}
+
+// readingListener reads the network while handling device notifications.
+type readingListener struct {
+	network *Network
+	found   []bool
+	mx      sync.Mutex
+}
+
+func (l *readingListener) DeviceAdded(d Device) {
+	l.network.Groups()
+	l.network.Coordinator()
+	_, ok := l.network.Device(d.NetworkAddress)
+	l.mx.Lock()
+	l.found = append(l.found, ok)
+	l.mx.Unlock()
+}
+
+func (l *readingListener) DeviceUpdated(Device) {}
+
+func (l *readingListener) DeviceRemoved(d Device) {
+	_, ok := l.network.Device(d.NetworkAddress)
+	l.mx.Lock()
+	l.found = append(l.found, !ok)
+	l.mx.Unlock()
+}
+
+func TestOrderedNotificationsAllowReadingListeners(t *testing.T) {
+	n := NewNetworkState(true, WithOrderedNotifications())
+	n.AddNetworkListener(&readingListener{network: n})
+	waitDone(t, func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					n.AddGroup(GroupAddress{GroupID: uint32(i*100 + j), Label: "group"})
+				}
+			}(i)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					n.ReplaceDevices([]Device{testDevice(uint64(j+1), uint32(i*100+j))})
+					n.AddDevice(testDevice(uint64(j+1000), uint32(i*100+j+1000)))
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+}
+
+// labelListener records the labels of updated devices.
+type labelListener struct {
+	mx     sync.Mutex
+	labels []string
+}
+
+func (l *labelListener) DeviceAdded(Device) {}
+
+func (l *labelListener) DeviceUpdated(d Device) {
+	l.mx.Lock()
+	l.labels = append(l.labels, d.Label)
+	l.mx.Unlock()
+}
+
+func (l *labelListener) DeviceRemoved(Device) {}
+
+func TestOrderedNotificationsFollowCommitOrder(t *testing.T) {
+	n := NewNetworkState(true, WithOrderedNotifications())
+	n.AddDevice(testDevice(1, 1))
+	listener := &labelListener{}
+	n.AddNetworkListener(listener)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				n.SetDeviceLabel(1, fmt.Sprintf("label %d-%d", i, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+	device, _ := n.Device(NewDeviceAddress(1, 1))
+	if len(listener.labels) != 400 || listener.labels[399] != device.Label {
+		t.Fatalf("Expected 400 updates ending with %q, got %d ending with %q", device.Label, len(listener.labels), listener.labels[len(listener.labels)-1])
+	}
+}
+
+func TestListenersNotifiedAfterUnlock(t *testing.T) {
+	n := NewNetworkState(true)
+	listener := &readingListener{network: n}
+	n.AddNetworkListener(listener)
+	n.AddDevice(testDevice(1, 1))
+	n.RemoveDevice(testDevice(1, 1))
+	if len(listener.found) != 2 || !listener.found[0] || !listener.found[1] {
+		t.Fatalf("Expected listeners to see the committed change, got %v", listener.found)
+	}
+}
+
+func TestNilListenersIgnored(t *testing.T) {
+	n := NewNetworkState(true)
+	if handle := n.AddNetworkListener(nil); handle != 0 {
+		t.Fatalf("Expected no handle for a nil listener, got %d", handle)
+	}
+	n.AddGroupListener(nil)
+	n.AddCommandListener(nil)
+	n.AddAckListener(nil)
+	n.RemoveNetworkListener(nil)
+	n.AddDevice(testDevice(1, 1))
+	n.SetDeviceLabel(1, "lamp")
+	n.RemoveDeviceByIEEE(1)
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.DispatchCommand("command")
+	n.NotifyAck("command", nil)
+	if count := n.ListenerCount() + n.CommandListenerCount(); count != 0 {
+		t.Fatalf("Expected nil listeners not to be registered, got %d", count)
+	}
+}
+
+// blockingListener records added devices, blocking on the first notification until released.
+type blockingListener struct {
+	release chan struct{}
+	mx      sync.Mutex
+	added   []uint32
+}
+
+func (l *blockingListener) DeviceAdded(d Device) {
+	<-l.release
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.added = append(l.added, d.NetworkAddress.NetworkAddress)
+}
+
+func (l *blockingListener) DeviceUpdated(Device) {}
+func (l *blockingListener) DeviceRemoved(Device) {}
+
+func (l *blockingListener) Added() []uint32 {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return append([]uint32(nil), l.added...)
+}
+
+func TestAsyncNotificationsDontBlockMutators(t *testing.T) {
+	n := NewNetworkState(true, WithAsyncNotifications(10))
+	defer n.stopEvents()
+	listener := &blockingListener{release: make(chan struct{})}
+	n.AddNetworkListener(listener)
+	waitDone(t, func() {
+		for i := uint32(1); i <= 20; i++ {
+			n.AddDevice(testDevice(uint64(i), i))
+		}
+	})
+	dropped := n.DroppedNotifications()
+	if dropped == 0 {
+		t.Fatal("Expected notifications exceeding the queue to be dropped")
+	}
+	close(listener.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for uint64(len(listener.Added()))+dropped < 20 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d notifications to be delivered, got %v", 20-dropped, listener.Added())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	added := listener.Added()
+	for i := 1; i < len(added); i++ {
+		if added[i] <= added[i-1] {
+			t.Fatalf("Expected notifications in order, got %v", added)
+		}
+	}
+}
+
+// observingListener records network, group and command events.
+type observingListener struct {
+	recordingListener
+}
+
+func (l *observingListener) CommandReceived(command Command) { l.record("command %v", command) }
+
+func TestRegisterObserver(t *testing.T) {
+	n := NewNetworkState(true)
+	observer := &observingListener{}
+	n.RegisterObserver(observer)
+	n.AddDevice(testDevice(1, 1))
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.DispatchCommand("on")
+	expected := []string{"added 1/1", "group added 1", "command on"}
+	if events := observer.Events(); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+	n.UnregisterObserver(observer)
+	n.AddDevice(testDevice(2, 2))
+	n.AddGroup(GroupAddress{GroupID: 2, Label: "garden"})
+	n.DispatchCommand("off")
+	if events := observer.Events(); len(events) != len(expected) {
+		t.Fatalf("Expected no events after unregistering, got %v", events)
+	}
+}
+
+func TestSubscribeTwice(t *testing.T) {
+	n := NewNetworkState(true)
+	listener := &recordingListener{}
+	unsubscribe := n.Subscribe(listener)
+	n.Subscribe(listener)
+	n.AddDevice(testDevice(1, 1))
+	if events := listener.Events(); len(events) != 2 {
+		t.Fatalf("Expected a notification per registration, got %v", events)
+	}
+	unsubscribe()
+	unsubscribe()
+	n.AddDevice(testDevice(2, 2))
+	if events := listener.Events(); len(events) != 3 || n.ListenerCount() != 1 {
+		t.Fatalf("Expected a single registration to be removed, got %v and %d listeners", events, n.ListenerCount())
+	}
+}
+
+// funcListener is a non-comparable listener, notifying every device change to a function.
+type funcListener func(Device)
+
+func (f funcListener) DeviceAdded(d Device)               { f(d) }
+func (f funcListener) DeviceUpdated(d Device)             { f(d) }
+func (f funcListener) DeviceRemoved(d Device)             { f(d) }
+func (f funcListener) GroupAdded(GroupAddress)            {}
+func (f funcListener) GroupUpdated(GroupAddress)          {}
+func (f funcListener) GroupRemoved(GroupAddress)          {}
+func (f funcListener) CommandReceived(Command)            {}
+func (f funcListener) CommandAcknowledged(Command, error) {}
+
+func TestNonComparableListeners(t *testing.T) {
+	n := NewNetworkState(true)
+	notified := 0
+	listener := funcListener(func(Device) { notified++ })
+	handle := n.AddNetworkListener(listener)
+	n.AddGroupListener(listener)
+	n.AddCommandListener(listener)
+	n.AddAckListener(listener)
+	n.RemoveNetworkListener(listener)
+	n.RemoveGroupListener(listener)
+	n.RemoveCommandListener(listener)
+	n.RemoveAckListener(listener)
+	n.AddDevice(testDevice(1, 1))
+	if notified != 1 {
+		t.Fatalf("Expected the listener to be notified once, got %d", notified)
+	}
+	n.RemoveNetworkListenerHandle(handle)
+	n.AddDevice(testDevice(2, 2))
+	if notified != 1 || n.ListenerCount() != 0 {
+		t.Fatalf("Expected the listener to be removed by handle, got %d notifications", notified)
+	}
+}
+
+func TestAddNetworkListenerWithReplay(t *testing.T) {
+	n := NewNetworkState(true)
+	populateNetwork(n)
+	listener := &recordingListener{}
+	n.AddNetworkListenerWithReplay(listener)
+	events := listener.Events()
+	sort.Strings(events)
+	if !reflect.DeepEqual(events, []string{"added 1/1", "added 2/1", "added 3/1"}) {
+		t.Fatalf("Expected existing devices to be replayed, got %v", events)
+	}
+	n.RemoveDeviceByIEEE(1)
+	if events := listener.Events(); events[len(events)-1] != "removed 1/1" {
+		t.Fatalf("Expected later changes to be notified, got %v", events)
+	}
+}
+
+func TestAddNetworkListenerWithReplayChangingNetwork(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddDevice(testDevice(1, 1))
+	n.AddDevice(testDevice(2, 2))
+	listener := funcListener(func(d Device) {
+		if d.IEEEAddress < 10 {
+			n.AddDevice(testDevice(d.IEEEAddress+10, uint32(d.IEEEAddress+10)))
+		}
+	})
+	waitDone(t, func() {
+		n.AddNetworkListenerWithReplay(listener)
+	})
+	if addresses := networkAddresses(n.DevicesSorted()); !reflect.DeepEqual(addresses, []uint32{1, 2, 11, 12}) {
+		t.Fatalf("Expected the listener to add a device for each replayed one, got %v", addresses)
+	}
+}
+
+func TestAddNetworkListenerWithReplayAsync(t *testing.T) {
+	n := NewNetworkState(true, WithAsyncNotifications(10))
+	blocking := &blockingListener{release: make(chan struct{})}
+	n.AddNetworkListener(blocking)
+	n.AddDevice(testDevice(1, 1))
+	n.AddDevice(testDevice(2, 2))
+	listener := &recordingListener{}
+	n.AddNetworkListenerWithReplay(listener)
+	n.AddDevice(testDevice(3, 3))
+	close(blocking.release)
+	n.stopEvents()
+	events := listener.Events()
+	sort.Strings(events)
+	if !reflect.DeepEqual(events, []string{"added 1/1", "added 2/1", "added 3/1"}) {
+		t.Fatalf("Expected each device to be notified exactly once, got %v", events)
+	}
+}
+
+func (l *labelListener) Labels() []string {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return append([]string(nil), l.labels...)
+}
+
+func TestUpdateDebounce(t *testing.T) {
+	n := NewNetworkState(true, WithUpdateDebounce(50*time.Millisecond))
+	n.AddDevice(testDevice(1, 1))
+	listener := &labelListener{}
+	n.AddNetworkListener(listener)
+	for i := 0; i < 100; i++ {
+		n.SetDeviceLabel(1, fmt.Sprintf("label %d", i))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(listener.Labels()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the debounced update to be notified")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	labels := listener.Labels()
+	if len(labels) > 10 || labels[len(labels)-1] != "label 99" {
+		t.Fatalf("Expected few notifications ending with the latest state, got %d ending with %q", len(labels), labels[len(labels)-1])
+	}
+	if device, _ := n.Device(NewDeviceAddress(1, 1)); device.Label != "label 99" {
+		t.Fatalf("Expected the device to be stored immediately, got %q", device.Label)
+	}
+	n.SetDeviceLabel(1, "removed")
+	n.RemoveDeviceByIEEE(1)
+	time.Sleep(100 * time.Millisecond)
+	if latest := listener.Labels(); len(latest) != len(labels) {
+		t.Fatalf("Expected pending updates of removed devices to be discarded, got %v", latest[len(labels):])
+	}
+}
+
+func TestUpdateDebounceEndpoints(t *testing.T) {
+	n := NewNetworkState(true, WithUpdateDebounce(50*time.Millisecond))
+	first, second, third := testDevice(1, 1), testDevice(1, 1), testDevice(1, 1)
+	second.NetworkAddress = NewDeviceAddress(1, 2)
+	third.NetworkAddress = NewDeviceAddress(1, 3)
+	n.AddDevice(first)
+	n.AddDevice(second)
+	n.AddDevice(third)
+	listener := &labelListener{}
+	n.AddNetworkListener(listener)
+	first.Label, second.Label, third.Label = "first", "second", "third"
+	n.UpdateDevice(first)
+	n.UpdateDevice(second)
+	n.UpdateDevice(third)
+	n.RemoveDevice(third)
+	time.Sleep(150 * time.Millisecond)
+	labels := listener.Labels()
+	sort.Strings(labels)
+	if !reflect.DeepEqual(labels, []string{"first", "second"}) {
+		t.Fatalf("Expected the updates of the remaining endpoints, got %v", labels)
+	}
+}
+
+func TestShutdownDeliversQueuedNotifications(t *testing.T) {
+	n := newTestNetwork(t, WithAsyncNotifications(1000))
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	for i := uint32(1); i <= 500; i++ {
+		n.AddDevice(testDevice(uint64(i), i))
+	}
+	if err := n.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if events, dropped := listener.Events(), n.DroppedNotifications(); len(events) != 500 || dropped != 0 {
+		t.Fatalf("Expected all queued notifications to be delivered, got %d with %d dropped", len(events), dropped)
+	}
+	n.AddDevice(testDevice(501, 501))
+	if dropped := n.DroppedNotifications(); dropped != 1 {
+		t.Fatalf("Expected notifications after shutdown to be dropped, got %d dropped", dropped)
+	}
+}
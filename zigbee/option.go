@@ -0,0 +1,201 @@
+package zigbee
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// NetworkOption is a function used to customize a Network at creation time.
+type NetworkOption func(*Network)
+
+// WithGzipState will enable the gzip compression of the network state file.
+// The state file path is not changed. Compressed state files are detected by
+// their magic bytes on load, so both compressed and uncompressed files can be
+// loaded regardless of this option.
+func WithGzipState(enabled bool) NetworkOption {
+	return func(n *Network) {
+		n.gzipState = enabled
+	}
+}
+
+// WithAsyncNotifications will enable the asynchronous notification of network listeners.
+// Notifications are queued, up to queueSize, and delivered in order by a dedicated goroutine
+// that runs until Shutdown, which waits for the queued notifications to be delivered.
+// Notifications exceeding the queue capacity, or raised after Shutdown, are dropped and
+// counted in DroppedNotifications.
+func WithAsyncNotifications(queueSize int) NetworkOption {
+	return func(n *Network) {
+		if queueSize < 0 {
+			queueSize = 0
+		}
+		n.events = make(chan func(), queueSize)
+	}
+}
+
+// WithoutResetSave will prevent a network created with reset from overwriting the state file on Shutdown,
+// unless the state has been explicitly saved with Save.
+func WithoutResetSave() NetworkOption {
+	return func(n *Network) {
+		n.skipResetSave = true
+	}
+}
+
+// WithStartupHook will register a hook invoked at the end of a successful Startup with its result.
+func WithStartupHook(hook func(StartupResult)) NetworkOption {
+	return func(n *Network) {
+		n.startupHook = hook
+	}
+}
+
+// WithCorruptionRecovery will make Startup discard a state file that can't be decoded, starting with an empty
+// network instead of failing.
+func WithCorruptionRecovery() NetworkOption {
+	return func(n *Network) {
+		n.recoverCorruption = true
+	}
+}
+
+// WithDeviceNormalizer will register a function transforming devices before they are stored by AddDevice and
+// UpdateDevice. Any change to the device network address made by the normalizer is ignored.
+func WithDeviceNormalizer(normalizer func(Device) Device) NetworkOption {
+	return func(n *Network) {
+		n.deviceNormalizer = normalizer
+	}
+}
+
+// WithMaxDevices will limit the number of devices in the network. Adding a device beyond the limit fails, while
+// replacing an existing device is always allowed. A limit lower or equal to zero means no limit.
+func WithMaxDevices(max int) NetworkOption {
+	return func(n *Network) {
+		n.maxDevices = max
+	}
+}
+
+// WithCodec will set the codec used to encode the network state file. JSONCodec is used by default.
+func WithCodec(codec Codec) NetworkOption {
+	return func(n *Network) {
+		n.codec = codec
+	}
+}
+
+// WithClusterValidation will make AddDeviceChecked reject devices with cluster ids outside the 16-bit range. When
+// known cluster ids are supplied, devices with other cluster ids are accepted but a warning is logged.
+func WithClusterValidation(knownClusters ...uint32) NetworkOption {
+	return func(n *Network) {
+		n.validateClusters = true
+		n.knownClusters = make(map[uint32]bool, len(knownClusters))
+		for _, id := range knownClusters {
+			n.knownClusters[id] = true
+		}
+	}
+}
+
+// WithUpdateDebounce will coalesce the update notifications of a device received within the supplied window into a
+// single notification carrying the latest device state. Devices are stored immediately, only notifications are
+// delayed.
+func WithUpdateDebounce(window time.Duration) NetworkOption {
+	return func(n *Network) {
+		n.updateDebounce = window
+	}
+}
+
+// WithOrderedNotifications will guarantee that listeners are notified in the same order changes are committed, even
+// when concurrent changes notify listeners after releasing the network locks. Listeners can read the network, but
+// must not change it synchronously while handling a notification, since the change would wait for the notification
+// to complete.
+func WithOrderedNotifications() NetworkOption {
+	return func(n *Network) {
+		n.orderedNotifications = true
+	}
+}
+
+// WithStateShards will split the network state across the supplied number of files, named after the state file
+// with the shard index before its extension. Devices are assigned to shards by a hash of their network address,
+// while groups and memberships are stored in the first shard. Startup loads and merges all the shards, and Flush
+// rewrites only the shards changed since the last save.
+func WithStateShards(shards int) NetworkOption {
+	return func(n *Network) {
+		n.stateShards = shards
+	}
+}
+
+// WithStaleEviction will periodically remove, every interval, the devices whose last seen time is older than maxAge,
+// notifying listeners of each removal. Devices never seen are not evicted. The sweeper runs until Shutdown.
+func WithStaleEviction(maxAge, interval time.Duration) NetworkOption {
+	return func(n *Network) {
+		n.evictionMaxAge = maxAge
+		n.evictionInterval = interval
+	}
+}
+
+// WithDeviceKey will configure the function computing the key identifying devices in the network, allowing devices
+// with colliding network addresses to coexist. The key must depend only on fields not changed by updates. By
+// default devices are identified by their network address.
+func WithDeviceKey(key func(Device) string) NetworkOption {
+	return func(n *Network) {
+		n.deviceKeyFunc = key
+	}
+}
+
+// WithWriteAheadLog will append a JSON line to w for each committed device, group and membership mutation, so that
+// the changes made since the last save can be recovered with ReplayWAL after a crash. Loading state is not logged.
+func WithWriteAheadLog(w io.Writer) NetworkOption {
+	return func(n *Network) {
+		n.wal = w
+	}
+}
+
+// WithSaveHook will register a hook invoked with the bytes written to the state file, after each successful write
+// made by Save, Flush or Shutdown. When state is sharded, the hook is invoked once for each shard file written. The
+// hook runs synchronously while saving, so it must return promptly: slow work, like uploading state to a remote
+// backup, should be handed off to another goroutine. The hook may retain the bytes.
+func WithSaveHook(hook func([]byte)) NetworkOption {
+	return func(n *Network) {
+		n.saveHook = hook
+	}
+}
+
+// WithStateFileMode will set the permissions of the state files, 0644 by default. The permissions are applied to
+// the temporary file before it's renamed, so the state file never has different permissions.
+func WithStateFileMode(mode os.FileMode) NetworkOption {
+	return func(n *Network) {
+		n.fileMode = mode
+	}
+}
+
+// WithSaveRetries will retry state file writes failing with transient I/O errors, such as EIO or EAGAIN, up to the
+// supplied number of attempts. The first retry waits for backoff, and the delay doubles after each retry. Permanent
+// failures, such as a full disk or missing permissions, are not retried.
+func WithSaveRetries(attempts int, backoff time.Duration) NetworkOption {
+	return func(n *Network) {
+		n.saveAttempts = attempts
+		n.saveBackoff = backoff
+	}
+}
+
+// WithLabelPolicy will set how device and group labels that are not valid UTF-8 are handled when devices and groups
+// are added or updated. By default invalid bytes are replaced with U+FFFD.
+func WithLabelPolicy(policy LabelPolicy) NetworkOption {
+	return func(n *Network) {
+		n.labelPolicy = policy
+	}
+}
+
+// WithListenerOrder will set the order in which network, group and command listeners are notified. By default
+// listeners are notified in registration order.
+func WithListenerOrder(order ListenerOrder) NetworkOption {
+	return func(n *Network) {
+		n.listenerOrder = order
+	}
+}
+
+// WithStreamingSave will save the network state by encoding devices and groups one at a time straight to the state
+// file, instead of building the whole encoded state in memory, reducing the peak memory of very large networks. The
+// streamed content is identical to the default one. It has no effect with a custom codec or a save hook, which need
+// the whole encoded state.
+func WithStreamingSave() NetworkOption {
+	return func(n *Network) {
+		n.streamingSave = true
+	}
+}
@@ -0,0 +1,22 @@
+package zigbee
+
+// ListenerOrder defines the order in which listeners are notified.
+type ListenerOrder int
+
+const (
+	// FIFO notifies listeners in registration order. It's the default order.
+	FIFO ListenerOrder = iota
+	// LIFO notifies the last registered listener first.
+	LIFO
+)
+
+func (o ListenerOrder) String() string {
+	switch o {
+	case FIFO:
+		return "FIFO"
+	case LIFO:
+		return "LIFO"
+	default:
+		return "Unknown"
+	}
+}
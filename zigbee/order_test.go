@@ -0,0 +1,64 @@
+package zigbee
+
+import (
+	"reflect"
+	"testing"
+)
+
+// orderListener records its name in a shared log whenever it's notified.
+type orderListener struct {
+	name string
+	log  *[]string
+}
+
+func (l *orderListener) record()                                 { *l.log = append(*l.log, l.name) }
+func (l *orderListener) DeviceAdded(Device)                      { l.record() }
+func (l *orderListener) DeviceUpdated(Device)                    { l.record() }
+func (l *orderListener) DeviceRemoved(Device)                    { l.record() }
+func (l *orderListener) GroupAdded(GroupAddress)                 { l.record() }
+func (l *orderListener) GroupUpdated(GroupAddress)               { l.record() }
+func (l *orderListener) GroupRemoved(GroupAddress)               { l.record() }
+func (l *orderListener) GroupMemberAdded(GroupAddress, uint64)   {}
+func (l *orderListener) GroupMemberRemoved(GroupAddress, uint64) {}
+func (l *orderListener) CommandReceived(Command)                 { l.record() }
+func (l *orderListener) CommandAcknowledged(Command, error)      { l.record() }
+
+func TestListenerOrder(t *testing.T) {
+	for _, test := range []struct {
+		order    ListenerOrder
+		expected []string
+	}{
+		{FIFO, []string{"second", "third"}},
+		{LIFO, []string{"third", "second"}},
+	} {
+		t.Run(test.order.String(), func(t *testing.T) {
+			var log []string
+			n := NewNetworkState(true, WithListenerOrder(test.order))
+			listeners := []*orderListener{{"first", &log}, {"second", &log}, {"third", &log}}
+			for _, listener := range listeners {
+				n.AddNetworkListener(listener)
+				n.AddGroupListener(listener)
+				n.AddCommandListener(listener)
+				n.AddAckListener(listener)
+			}
+			n.RemoveNetworkListener(listeners[0])
+			n.RemoveGroupListener(listeners[0])
+			n.RemoveCommandListener(listeners[0])
+			n.RemoveAckListener(listeners[0])
+
+			notifications := map[string]func(){
+				"device":  func() { n.AddDevice(testDevice(1, 1)) },
+				"group":   func() { n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"}) },
+				"command": func() { n.DispatchCommand("command") },
+				"ack":     func() { n.NotifyAck("command", nil) },
+			}
+			for kind, notify := range notifications {
+				log = nil
+				notify()
+				if !reflect.DeepEqual(log, test.expected) {
+					t.Fatalf("Expected %s listeners notified in order %v, got %v", kind, test.expected, log)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package zigbee
+
+// Reload will read again the state files, reconciling the network with their content. Instead of replacing the
+// whole state, devices, groups and memberships are added, updated and removed as needed, and listeners are notified
+// of the differences only. Transient devices, which are never saved, are kept. Memberships of groups not in the
+// state files are ignored, and the coordinator is replaced with the saved one.
+func (n *Network) Reload() error {
+	if n.Frozen() {
+		return ErrNetworkFrozen
+	}
+	state, err := n.readStateSnapshot()
+	if err != nil {
+		return err
+	}
+	n.devicesMx.Lock()
+	defer n.unlockDevices()
+	devices := make([]Device, 0, len(state.Devices))
+	for _, device := range state.Devices {
+		devices = append(devices, n.normalizeDevice(device))
+	}
+	for _, device := range n.devices {
+		if device.Transient {
+			devices = append(devices, device)
+		}
+	}
+	addedDevices, updatedDevices, removedDevices := n.replaceDevices(devices)
+	if !equalCoordinators(n.coordinator, state.Coordinator) {
+		n.coordinator = state.Coordinator
+		n.markDirty()
+	}
+	for _, device := range removedDevices {
+		n.cancelDebouncedUpdate(device)
+	}
+	n.queueDevicesDispatch(func() {
+		n.dispatchDeviceChanges(addedDevices, updatedDevices, removedDevices)
+	})
+	n.groupsMx.Lock()
+	defer n.unlockNestedGroups()
+	addedGroups, updatedGroups, removedGroups := n.replaceGroups(state.Groups)
+	// Group changes are queued before the membership ones, so that members are notified after their group is added
+	n.queueGroupsDispatch(func() {
+		n.dispatchGroupChanges(addedGroups, updatedGroups, removedGroups)
+	})
+	n.replaceMemberships(state.Memberships)
+	return nil
+}
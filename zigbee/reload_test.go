@@ -0,0 +1,55 @@
+package zigbee
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReloadModifiedStateFile(t *testing.T) {
+	n := newTestNetwork(t)
+	n.AddDevice(testDevice(1, 1))
+	n.AddDevice(testDevice(2, 2))
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroupMember(1, 1)
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	modified := NewNetworkState(false)
+	modified.filePath = n.filePath
+	if err := modified.Startup(); err != nil {
+		t.Fatal(err)
+	}
+	modified.SetDeviceLabel(1, "lamp")
+	modified.RemoveDeviceByIEEE(2)
+	modified.AddDevice(testDevice(3, 3))
+	modified.AddGroup(GroupAddress{GroupID: 2, Label: "garden"})
+	modified.AddGroupMember(2, 3)
+	if err := modified.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	n.AddGroupListener(listener)
+	if err := n.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"added 3/1", "updated 1/1", "removed 2/1", "group added 2", "member added 2 3"}
+	if events := listener.Events(); !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+	if device, _ := n.Device(NewDeviceAddress(1, 1)); device.Label != "lamp" {
+		t.Fatalf("Expected reloaded device label, got %v", device)
+	}
+	if members := n.GroupMembers(2); len(members) != 1 || members[0] != 3 {
+		t.Fatalf("Expected reloaded group members, got %v", members)
+	}
+
+	if err := n.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if events := listener.Events(); len(events) != len(expected) {
+		t.Fatalf("Expected no events reloading an unchanged file, got %v", events[len(expected):])
+	}
+}
@@ -0,0 +1,52 @@
+package zigbee
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Reset will clear the network state at runtime, removing all devices, including transient ones, groups and
+// memberships, and deleting the state files. Listeners are notified of every removed device and group. The network
+// is marked dirty, so the empty state is saved again by the next Flush. Unlike creating the network with reset true,
+// the reset is recorded and reported by LastResetTime.
+func (n *Network) Reset() error {
+	if n.Frozen() {
+		return ErrNetworkFrozen
+	}
+	n.withWriteLocks(func() {
+		_, _, removedDevices := n.replaceDevices(nil)
+		if n.coordinator != nil {
+			n.coordinator = nil
+			n.markDirty()
+		}
+		for _, device := range removedDevices {
+			n.cancelDebouncedUpdate(device)
+		}
+		// Memberships are cleared first, so that member removals are notified before the groups are dropped
+		n.replaceMemberships(nil)
+		_, _, removedGroups := n.replaceGroups(nil)
+		n.queueGroupsDispatch(func() {
+			n.dispatchDeviceChanges(nil, nil, removedDevices)
+			n.dispatchGroupChanges(nil, nil, removedGroups)
+		})
+	})
+
+	n.saveMx.Lock()
+	defer n.saveMx.Unlock()
+	for _, filePath := range n.stateFilePaths() {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return wrapError(CodeIO, err, fmt.Sprintf("Unable to remove network state file %s", filePath))
+		}
+	}
+	n.markAllDirty()
+	n.lastResetTime = time.Now()
+	return nil
+}
+
+// LastResetTime returns the time of the last successful Reset, or the zero time if the network has never been reset.
+func (n *Network) LastResetTime() time.Time {
+	n.saveMx.Lock()
+	defer n.saveMx.Unlock()
+	return n.lastResetTime
+}
@@ -0,0 +1,52 @@
+package zigbee
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReset(t *testing.T) {
+	n := newTestNetwork(t)
+	populateNetwork(n)
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	listener := &recordingListener{}
+	n.AddNetworkListener(listener)
+	n.AddGroupListener(listener)
+	if err := n.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.Devices()) != 0 || len(n.Groups()) != 0 || len(n.GroupMembers(1)) != 0 {
+		t.Fatalf("Expected the network to be cleared, got %v", n)
+	}
+	if _, err := os.Stat(n.filePath); !os.IsNotExist(err) {
+		t.Fatalf("Expected the state file to be removed, got %v", err)
+	}
+	if n.LastResetTime().IsZero() {
+		t.Fatal("Expected the reset time to be recorded")
+	}
+	events := listener.Events()
+	for _, event := range events[:3] {
+		if !strings.HasPrefix(event, "member removed") {
+			t.Fatalf("Expected member removals to be notified first, got %v", events)
+		}
+	}
+	sort.Strings(events)
+	expected := []string{
+		"group removed 1", "group removed 2", "member removed 1 1", "member removed 1 2", "member removed 2 3",
+		"removed 1/1", "removed 2/1", "removed 3/1",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+	if err := n.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := loadNetwork(t, n.filePath); len(loaded.Devices()) != 0 || len(loaded.Groups()) != 0 {
+		t.Fatalf("Expected the empty state to be saved by the next flush, got %v", loaded)
+	}
+}
@@ -0,0 +1,56 @@
+package zigbee
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+)
+
+// shardIndex returns the index of the state shard storing the device with supplied network address.
+func shardIndex(address DeviceAddress, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(address.String()))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// shardFilePath returns the path of the state shard with supplied index, inserting the index before the extension.
+func shardFilePath(path string, index int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), index, ext)
+}
+
+// splitShards will split the network state in the supplied number of shards. Groups and memberships are stored in
+// the first shard.
+func splitShards(state *SerializedNetwork, shards int) []*SerializedNetwork {
+	result := make([]*SerializedNetwork, shards)
+	for i := range result {
+		result[i] = &SerializedNetwork{}
+	}
+	result[0].Groups = state.Groups
+	result[0].Memberships = state.Memberships
+	result[0].Coordinator = state.Coordinator
+	for _, device := range state.Devices {
+		shard := result[shardIndex(device.NetworkAddress, shards)]
+		shard.Devices = append(shard.Devices, device)
+	}
+	return result
+}
+
+// sharded returns true if the network state is split across more than one file.
+func (n *Network) sharded() bool {
+	return n.stateShards > 1
+}
+
+// stateFilePaths returns the paths of the files storing the network state.
+func (n *Network) stateFilePaths() []string {
+	path := n.stateFilePath()
+	if !n.sharded() {
+		return []string{path}
+	}
+	paths := make([]string, n.stateShards)
+	for i := range paths {
+		paths[i] = shardFilePath(path, i)
+	}
+	return paths
+}
@@ -0,0 +1,114 @@
+package zigbee
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestShardIndexDeterministic(t *testing.T) {
+	for address := uint32(0); address < 100; address++ {
+		index := shardIndex(NewDeviceAddress(address, 1), 4)
+		if index < 0 || index >= 4 || index != shardIndex(NewDeviceAddress(address, 1), 4) {
+			t.Fatalf("Expected a stable shard for device %d, got %d", address, index)
+		}
+	}
+	if path := shardFilePath("/tmp/network.json", 2); path != "/tmp/network.2.json" {
+		t.Fatalf("Expected shard index before the extension, got %s", path)
+	}
+}
+
+func TestShardedStateRoundTrip(t *testing.T) {
+	n := newTestNetwork(t, WithStateShards(4))
+	for i := uint32(1); i <= 20; i++ {
+		n.AddDevice(testDevice(uint64(i), i))
+	}
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroupMember(1, 3)
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(1); i <= 20; i++ {
+		address := NewDeviceAddress(i, 1)
+		shard := NewNetworkState(true)
+		if err := shard.LoadFrom(shardFilePath(n.filePath, shardIndex(address, 4))); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := shard.Device(address); !ok {
+			t.Fatalf("Expected device %s in shard %d", address, shardIndex(address, 4))
+		}
+	}
+
+	loaded := NewNetworkState(false, WithStateShards(4))
+	loaded.filePath = n.filePath
+	if err := loaded.Startup(); err != nil {
+		t.Fatal(err)
+	}
+	if devices, groups := loaded.counts(); devices != 20 || groups != 1 {
+		t.Fatalf("Expected 20 devices and 1 group, got %d devices and %d groups", devices, groups)
+	}
+	if members := loaded.GroupMembers(1); len(members) != 1 || members[0] != 3 {
+		t.Fatalf("Expected group members to be loaded, got %v", members)
+	}
+}
+
+func TestFlushWritesChangedShardsOnly(t *testing.T) {
+	var written []string
+	n := newTestNetwork(t, WithStateShards(4), WithSaveHook(func(bytes []byte) {
+		written = append(written, string(bytes))
+	}))
+	for i := uint32(1); i <= 20; i++ {
+		n.AddDevice(testDevice(uint64(i), i))
+	}
+	if err := n.Flush(); err != nil || len(written) != 4 {
+		t.Fatalf("Expected all shards to be written, got %d writes and error %v", len(written), err)
+	}
+
+	written = nil
+	address := NewDeviceAddress(7, 1)
+	n.SetDeviceLabel(7, "lamp")
+	if err := n.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 1 || !strings.Contains(written[0], "lamp") {
+		t.Fatalf("Expected only shard %d to be written, got %v", shardIndex(address, 4), written)
+	}
+
+	written = nil
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	if err := n.Flush(); err != nil || len(written) != 1 || !strings.Contains(written[0], "kitchen") {
+		t.Fatalf("Expected only the first shard to be written, got %v and error %v", written, err)
+	}
+
+	written = nil
+	if err := n.Save(); err != nil || len(written) != 4 {
+		t.Fatalf("Expected save to write all shards, got %d writes and error %v", len(written), err)
+	}
+}
+
+func TestFlushRetriesFailedShards(t *testing.T) {
+	n := newTestNetwork(t, WithStateShards(2))
+	n.AddDevice(testDevice(1, 1))
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	n.SetDeviceLabel(1, "lamp")
+	n.filePath += ".missing/network.json"
+	if err := n.Flush(); err == nil {
+		t.Fatal("Expected flush to a missing directory to fail")
+	}
+	if !n.Dirty() {
+		t.Fatal("Expected failed flush to leave the network dirty")
+	}
+	if err := os.MkdirAll(n.filePath[:len(n.filePath)-len("/network.json")], 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(shardFilePath(n.filePath, shardIndex(NewDeviceAddress(1, 1), 2)))
+	if err != nil || !strings.Contains(string(content), "lamp") {
+		t.Fatalf("Expected the failed shard to be written again, got %s and error %v", content, err)
+	}
+}
@@ -0,0 +1,36 @@
+package zigbee
+
+import "time"
+
+// StartupOutcome identifies how the network state was initialized by Startup.
+type StartupOutcome int
+
+const (
+	// FreshStart means no state was loaded, either because of reset or because the state file does not exist.
+	FreshStart StartupOutcome = iota
+	// LoadedFromFile means the state was loaded from the state file.
+	LoadedFromFile
+	// RecoveredFromCorruption means the state file was corrupted and has been discarded.
+	RecoveredFromCorruption
+)
+
+func (o StartupOutcome) String() string {
+	switch o {
+	case FreshStart:
+		return "FreshStart"
+	case LoadedFromFile:
+		return "LoadedFromFile"
+	case RecoveredFromCorruption:
+		return "RecoveredFromCorruption"
+	default:
+		return "Unknown"
+	}
+}
+
+// StartupResult describes the result of a network Startup.
+type StartupResult struct {
+	Outcome  StartupOutcome
+	Devices  int
+	Groups   int
+	Duration time.Duration
+}
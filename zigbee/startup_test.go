@@ -0,0 +1,108 @@
+package zigbee
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// startupResults returns a startup hook recording the results in the supplied slice.
+func startupResults(results *[]StartupResult) NetworkOption {
+	return WithStartupHook(func(result StartupResult) {
+		*results = append(*results, result)
+	})
+}
+
+func TestStartupHookFreshStart(t *testing.T) {
+	var results []StartupResult
+	n := newTestNetwork(t, startupResults(&results))
+	if err := n.Startup(); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Outcome != FreshStart {
+		t.Fatalf("Expected a fresh start, got %v", results)
+	}
+}
+
+func TestStartupHookLoadedFromFile(t *testing.T) {
+	saved := newTestNetwork(t)
+	populateNetwork(saved)
+	if err := saved.Save(); err != nil {
+		t.Fatal(err)
+	}
+	var results []StartupResult
+	loadNetwork(t, saved.filePath, startupResults(&results))
+	if len(results) != 1 || results[0].Outcome != LoadedFromFile || results[0].Devices != 3 || results[0].Groups != 2 {
+		t.Fatalf("Expected state loaded from file, got %v", results)
+	}
+}
+
+func TestStartupHookRecoveredFromCorruption(t *testing.T) {
+	n := newTestNetwork(t)
+	if err := ioutil.WriteFile(n.filePath, []byte("{corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var results []StartupResult
+	loadNetwork(t, n.filePath, WithCorruptionRecovery(), startupResults(&results))
+	if len(results) != 1 || results[0].Outcome != RecoveredFromCorruption || results[0].Devices != 0 {
+		t.Fatalf("Expected recovery from corruption, got %v", results)
+	}
+}
+
+func TestStartupHookNotInvokedOnFailure(t *testing.T) {
+	var results []StartupResult
+	n := NewNetworkState(false, startupResults(&results))
+	n.filePath = newTestNetwork(t).filePath
+	if err := ioutil.WriteFile(n.filePath, []byte("{corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Startup(); err == nil {
+		t.Fatal("Expected corrupted state file to fail startup")
+	}
+	if len(results) != 0 {
+		t.Fatalf("Expected no hook invocation for a failed startup, got %v", results)
+	}
+}
+
+// slowCodec is a JSON codec taking the configured delay to encode and decode the network state.
+type slowCodec struct {
+	delay time.Duration
+}
+
+func (c slowCodec) Marshal(state *SerializedNetwork) ([]byte, error) {
+	time.Sleep(c.delay)
+	return JSONCodec.Marshal(state)
+}
+
+func (c slowCodec) Unmarshal(data []byte, state *SerializedNetwork) error {
+	time.Sleep(c.delay)
+	return JSONCodec.Unmarshal(data, state)
+}
+
+func TestStartupAndShutdownDurations(t *testing.T) {
+	delay := 20 * time.Millisecond
+	saved := newTestNetwork(t)
+	populateNetwork(saved)
+	if err := saved.Save(); err != nil {
+		t.Fatal(err)
+	}
+	var results []StartupResult
+	n := NewNetworkState(false, WithCodec(slowCodec{delay}), startupResults(&results))
+	n.filePath = saved.filePath
+	if n.LastStartupDuration() != 0 || n.LastShutdownDuration() != 0 {
+		t.Fatal("Expected no durations before startup")
+	}
+	if err := n.Startup(); err != nil {
+		t.Fatal(err)
+	}
+	if n.LastStartupDuration() < delay || results[0].Duration != n.LastStartupDuration() {
+		t.Fatalf("Expected a startup duration of at least %s, got %s and %s", delay, n.LastStartupDuration(), results[0].Duration)
+	}
+	n.SetDeviceLabel(1, "lamp")
+	if err := n.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if n.LastShutdownDuration() < delay {
+		t.Fatalf("Expected a shutdown duration of at least %s, got %s", delay, n.LastShutdownDuration())
+	}
+}
@@ -0,0 +1,264 @@
+package zigbee
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// gzipMagic is the header identifying gzip compressed content.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// compressState will gzip compress the supplied state bytes.
+func compressState(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressState will decompress the supplied state bytes if they are gzip
+// compressed, returning them untouched otherwise.
+func decompressState(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// readStateFile will load the network state from the file at supplied path.
+func (n *Network) readStateFile(path string) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return wrapError(CodeIO, err, fmt.Sprintf("Unable to read content of file %s", path))
+	}
+	return n.decodeStateFile(path, bytes)
+}
+
+// decodeStateFile will load the network state from the content of the file at supplied path.
+func (n *Network) decodeStateFile(path string, bytes []byte) error {
+	if err := n.decodeState(bytes); err != nil {
+		return errors.Wrapf(err, "Unable to load network state from file %s", path)
+	}
+	return nil
+}
+
+// writeStateFile will save the network state to the file at supplied path.
+func (n *Network) writeStateFile(path string) error {
+	bytes, err := n.encodeState()
+	if err != nil {
+		return errors.Wrapf(err, "Unable to save network state to file %s", path)
+	}
+	if err := n.writeStateData(path, bytes); err != nil {
+		return wrapError(CodeIO, err, fmt.Sprintf("Unable to write content to file %s", path))
+	}
+	return nil
+}
+
+// writeStateFiles will save the network state to the configured state files, one for each shard, skipping the shards
+// rejected by the supplied function. The save hook, if any, is invoked with the content of each file once written.
+func (n *Network) writeStateFiles(dirty func(shard int) bool) error {
+	paths := n.stateFilePaths()
+	states := []*SerializedNetwork{n.snapshot()}
+	if n.sharded() {
+		states = splitShards(states[0], len(paths))
+	}
+	for i, state := range states {
+		if !dirty(i) {
+			continue
+		}
+		if n.streamsState() {
+			err := n.writeStateWith(paths[i], func(w io.Writer) error {
+				return n.streamSnapshot(w, state)
+			})
+			if err != nil {
+				return wrapError(CodeIO, err, fmt.Sprintf("Unable to stream content to file %s", paths[i]))
+			}
+			continue
+		}
+		bytes, err := n.encodeSnapshot(state)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to save network state to file %s", paths[i])
+		}
+		if err := n.writeStateData(paths[i], bytes); err != nil {
+			return wrapError(CodeIO, err, fmt.Sprintf("Unable to write content to file %s", paths[i]))
+		}
+		if n.saveHook != nil {
+			n.saveHook(bytes)
+		}
+	}
+	return nil
+}
+
+// ReadState will load the network state from the supplied reader, using the configured codec and compression.
+func (n *Network) ReadState(r io.Reader) error {
+	bytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return wrapError(CodeIO, err, "Unable to read network state")
+	}
+	return n.decodeState(bytes)
+}
+
+// WriteState will save the network state to the supplied writer, using the configured codec and compression.
+func (n *Network) WriteState(w io.Writer) error {
+	bytes, err := n.encodeState()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(bytes); err != nil {
+		return wrapError(CodeIO, err, "Unable to write network state")
+	}
+	return nil
+}
+
+// decodeState will load the network state from its encoded form.
+func (n *Network) decodeState(bytes []byte) error {
+	state, err := n.decodeSnapshot(bytes)
+	if err != nil {
+		return err
+	}
+	n.restore(state)
+	return nil
+}
+
+// decodeSnapshot returns the network state snapshot decoded from its encoded form.
+func (n *Network) decodeSnapshot(bytes []byte) (*SerializedNetwork, error) {
+	bytes, err := decompressState(bytes)
+	if err != nil {
+		return nil, wrapError(CodeEncoding, err, "Unable to decompress network state")
+	}
+	var state SerializedNetwork
+	if err := n.stateCodec().Unmarshal(bytes, &state); err != nil {
+		return nil, wrapError(CodeEncoding, err, "Unable to unmarshal network state")
+	}
+	return &state, nil
+}
+
+// readStateSnapshot returns the network state snapshot read from the configured state files, merging all the
+// shards. An error is returned if no state file exists.
+func (n *Network) readStateSnapshot() (*SerializedNetwork, error) {
+	merged := &SerializedNetwork{}
+	found := false
+	for _, path := range n.stateFilePaths() {
+		bytes, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, wrapError(CodeIO, err, fmt.Sprintf("Unable to read content of file %s", path))
+		}
+		state, err := n.decodeSnapshot(bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to load network state from file %s", path)
+		}
+		merged.Devices = append(merged.Devices, state.Devices...)
+		merged.Groups = append(merged.Groups, state.Groups...)
+		merged.Memberships = append(merged.Memberships, state.Memberships...)
+		if state.Coordinator != nil {
+			merged.Coordinator = state.Coordinator
+		}
+		found = true
+	}
+	if !found {
+		return nil, newCodedError(CodeNotFound, fmt.Sprintf("Network state file %s not found", n.stateFilePath()))
+	}
+	return merged, nil
+}
+
+// encodeState returns the encoded form of the network state.
+func (n *Network) encodeState() ([]byte, error) {
+	return n.encodeSnapshot(n.snapshot())
+}
+
+// encodeSnapshot returns the encoded form of the supplied network state snapshot.
+func (n *Network) encodeSnapshot(state *SerializedNetwork) ([]byte, error) {
+	bytes, err := n.stateCodec().Marshal(state)
+	if err != nil {
+		return nil, wrapError(CodeEncoding, err, "Unable to marshal network state")
+	}
+	if n.gzipState {
+		bytes, err = compressState(bytes)
+		if err != nil {
+			return nil, wrapError(CodeEncoding, err, "Unable to compress network state")
+		}
+	}
+	return bytes, nil
+}
+
+// writeStateData will write the encoded state to the file at supplied path, retrying transient failures as
+// configured with WithSaveRetries.
+func (n *Network) writeStateData(path string, data []byte) error {
+	return n.writeStateWith(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeStateWith will write the state to the file at supplied path with the supplied function, retrying transient
+// failures as configured with WithSaveRetries. The delay between attempts doubles after each retry.
+func (n *Network) writeStateWith(path string, write func(io.Writer) error) error {
+	err := writeFileAtomic(path, n.stateFileMode(), write)
+	backoff := n.saveBackoff
+	for attempt := 1; err != nil && attempt < n.saveAttempts && retryableError(err); attempt++ {
+		log.Printf("Retrying write of file %s in %v: %v", path, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = writeFileAtomic(path, n.stateFileMode(), write)
+	}
+	return err
+}
+
+// retryableError will check if the error is a transient I/O failure, worth retrying. Other failures, like a full
+// disk or missing permissions, are permanent.
+func retryableError(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return ok && (errno == syscall.EIO || errno == syscall.EAGAIN || errno == syscall.EINTR)
+}
+
+// writeFileAtomic will write the content produced by write to a temporary file renamed to path once completed, so
+// that path never contains partially written content.
+func writeFileAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
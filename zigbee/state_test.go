@@ -0,0 +1,333 @@
+package zigbee
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// populateNetwork will add devices, groups and memberships to the supplied network.
+func populateNetwork(n *Network) {
+	for i := uint32(1); i <= 3; i++ {
+		device := testDevice(uint64(i), i)
+		device.Label = "device"
+		n.AddDevice(device)
+	}
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroup(GroupAddress{GroupID: 2, Label: "garden"})
+	n.AddGroupMember(1, 1)
+	n.AddGroupMember(1, 2)
+	n.AddGroupMember(2, 3)
+}
+
+// loadNetwork returns a network started from the state file at supplied path.
+func loadNetwork(t *testing.T, path string, options ...NetworkOption) *Network {
+	t.Helper()
+	n := NewNetworkState(false, options...)
+	n.filePath = path
+	if err := n.Startup(); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestGzipStateRoundTrip(t *testing.T) {
+	n := newTestNetwork(t, WithGzipState(true))
+	populateNetwork(n)
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(n.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(content, gzipMagic) {
+		t.Fatal("Expected the state file to be gzip compressed")
+	}
+	if loaded := loadNetwork(t, n.filePath, WithGzipState(true)); !loaded.Equal(n) {
+		t.Fatalf("Expected compressed state to round trip, got %v", loaded)
+	}
+	if loaded := loadNetwork(t, n.filePath); !loaded.Equal(n) {
+		t.Fatal("Expected compressed state to be loaded without the option")
+	}
+}
+
+func TestGzipStateLoadsPlainFile(t *testing.T) {
+	n := newTestNetwork(t)
+	populateNetwork(n)
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := loadNetwork(t, n.filePath, WithGzipState(true)); !loaded.Equal(n) {
+		t.Fatal("Expected plain state to be loaded with compression enabled")
+	}
+}
+
+func TestSaveToAlternatePath(t *testing.T) {
+	n := newTestNetwork(t)
+	populateNetwork(n)
+	path := filepath.Join(t.TempDir(), "export.json")
+	if err := n.SaveTo(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(n.filePath); !os.IsNotExist(err) {
+		t.Fatalf("Expected the configured state file to be untouched, got %v", err)
+	}
+	loaded := NewNetworkState(true)
+	if err := loaded.LoadFrom(path); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(n) {
+		t.Fatal("Expected the exported state to round trip")
+	}
+}
+
+func TestLegacyStateFile(t *testing.T) {
+	device := `{"ieeeAddress":1,"networkAddress":{"networkAddress":1,"endpoint":1},"inputClusterIds":[6]}`
+	for name, state := range map[string]string{
+		"legacy":  " [" + device + "]",
+		"current": `{"devices":[` + device + `],"groups":[{"groupId":1,"label":"kitchen"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "network.json")
+			if err := ioutil.WriteFile(path, []byte(state), 0644); err != nil {
+				t.Fatal(err)
+			}
+			n := loadNetwork(t, path)
+			if _, ok := n.Device(NewDeviceAddress(1, 1)); !ok {
+				t.Fatalf("Expected device to be loaded from %s state", name)
+			}
+			var unmarshalled Network
+			if err := json.Unmarshal([]byte(state), &unmarshalled); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := unmarshalled.Device(NewDeviceAddress(1, 1)); !ok {
+				t.Fatalf("Expected device to be unmarshalled from %s state", name)
+			}
+		})
+	}
+}
+
+// failingWriter is a writer always failing.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, os.ErrClosed }
+
+func TestReadWriteState(t *testing.T) {
+	for _, options := range [][]NetworkOption{nil, {WithGzipState(true)}} {
+		n := NewNetworkState(true, options...)
+		populateNetwork(n)
+		var buffer bytes.Buffer
+		if err := n.WriteState(&buffer); err != nil {
+			t.Fatal(err)
+		}
+		loaded := NewNetworkState(true, options...)
+		if err := loaded.ReadState(&buffer); err != nil {
+			t.Fatal(err)
+		}
+		if !loaded.Equal(n) {
+			t.Fatalf("Expected the state to round trip, got %v", loaded)
+		}
+		if err := n.WriteState(failingWriter{}); CodeOf(err) != CodeIO {
+			t.Fatalf("Expected an IO error writing to a failing writer, got %v", err)
+		}
+	}
+}
+
+func TestTransientDevicesNotSaved(t *testing.T) {
+	n := newTestNetwork(t)
+	n.AddDevice(testDevice(1, 1))
+	transient := testDevice(2, 2)
+	transient.Transient = true
+	n.AddDevice(transient)
+	if _, ok := n.Device(transient.NetworkAddress); !ok || len(n.Devices()) != 2 {
+		t.Fatalf("Expected transient devices to be in the network, got %v", n.Devices())
+	}
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(n.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, []byte(`"transient"`)) {
+		t.Fatalf("Expected transient devices not to be saved, got %s", content)
+	}
+	loaded := loadNetwork(t, n.filePath)
+	if _, ok := loaded.Device(transient.NetworkAddress); ok || len(loaded.Devices()) != 1 {
+		t.Fatalf("Expected only persistent devices to be loaded, got %v", loaded.Devices())
+	}
+}
+
+func TestLargeIEEEAddressesRoundTrip(t *testing.T) {
+	n := newTestNetwork(t)
+	ieees := []uint64{0x00124B0001020304, 0x8000000000000001, 0xFFFFFFFFFFFFFFFE}
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	for i, ieee := range ieees {
+		n.AddDevice(testDevice(ieee, uint32(i+1)))
+		n.AddGroupMember(1, ieee)
+	}
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(n.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(content, []byte(`"0xfffffffffffffffe"`)) {
+		t.Fatalf("Expected IEEE addresses to be saved as hex strings, got %s", content)
+	}
+	loaded := loadNetwork(t, n.filePath)
+	if !loaded.Equal(n) {
+		t.Fatalf("Expected large IEEE addresses to survive save and load, got %v", loaded.Devices())
+	}
+	var device Device
+	if err := json.Unmarshal([]byte(`{"ieeeAddress":5149013231869700}`), &device); err != nil || device.IEEEAddress != 5149013231869700 {
+		t.Fatalf("Expected numeric IEEE addresses to be accepted, got %x and %v", device.IEEEAddress, err)
+	}
+}
+
+func TestSaveIsDeterministic(t *testing.T) {
+	n := newTestNetwork(t)
+	populateNetwork(n)
+	n.AddGroupMember(1, 3)
+	var contents [][]byte
+	for i := 0; i < 2; i++ {
+		if err := n.Save(); err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(n.filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, content)
+	}
+	reversed := reversedNetwork()
+	reversed.AddGroupMember(1, 3)
+	reversed.filePath = filepath.Join(filepath.Dir(n.filePath), "reversed.json")
+	if err := reversed.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(reversed.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents = append(contents, content)
+	if !bytes.Equal(contents[0], contents[1]) || !bytes.Equal(contents[0], contents[2]) {
+		t.Fatalf("Expected identical state files, got %s, %s and %s", contents[0], contents[1], contents[2])
+	}
+}
+
+func TestSaveHook(t *testing.T) {
+	var saved [][]byte
+	n := newTestNetwork(t, WithSaveHook(func(data []byte) {
+		saved = append(saved, data)
+	}))
+	populateNetwork(n)
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(n.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || !bytes.Equal(saved[0], content) {
+		t.Fatalf("Expected the hook to receive the file content, got %d invocations", len(saved))
+	}
+	n.filePath = filepath.Join(n.filePath, "missing", "state.json")
+	if err := n.Save(); err == nil || len(saved) != 1 {
+		t.Fatalf("Expected the hook not to be invoked on failed saves, got %v and %d invocations", err, len(saved))
+	}
+}
+
+func TestStateFileMode(t *testing.T) {
+	for _, test := range []struct {
+		options []NetworkOption
+		mode    os.FileMode
+	}{
+		{nil, 0644},
+		{[]NetworkOption{WithStateFileMode(0600)}, 0600},
+	} {
+		n := newTestNetwork(t, test.options...)
+		populateNetwork(n)
+		for i := 0; i < 2; i++ {
+			if err := n.Save(); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(n.filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode().Perm(); mode != test.mode {
+				t.Fatalf("Expected state file mode %v, got %v", test.mode, mode)
+			}
+		}
+	}
+}
+
+// flakyWrite returns a state write function failing with err the supplied number of times before succeeding.
+func flakyWrite(failures int, err error, attempts *int) func(io.Writer) error {
+	return func(w io.Writer) error {
+		*attempts++
+		if *attempts <= failures {
+			return err
+		}
+		_, err := w.Write([]byte("{}"))
+		return err
+	}
+}
+
+func TestSaveRetries(t *testing.T) {
+	n := newTestNetwork(t, WithSaveRetries(3, time.Millisecond))
+	attempts := 0
+	if err := n.writeStateWith(n.filePath, flakyWrite(2, syscall.EIO, &attempts)); err != nil || attempts != 3 {
+		t.Fatalf("Expected transient failures to be retried, got %v after %d attempts", err, attempts)
+	}
+	attempts = 0
+	if err := n.writeStateWith(n.filePath, flakyWrite(3, syscall.EAGAIN, &attempts)); err != syscall.EAGAIN || attempts != 3 {
+		t.Fatalf("Expected retries to stop after 3 attempts, got %v after %d attempts", err, attempts)
+	}
+	attempts = 0
+	if err := n.writeStateWith(n.filePath, flakyWrite(1, syscall.ENOSPC, &attempts)); err != syscall.ENOSPC || attempts != 1 {
+		t.Fatalf("Expected permanent failures not to be retried, got %v after %d attempts", err, attempts)
+	}
+	if _, err := os.Stat(n.filePath); err != nil {
+		t.Fatalf("Expected the state file written by the successful attempt, got %v", err)
+	}
+}
+
+func TestLastSaveTime(t *testing.T) {
+	n := newTestNetwork(t)
+	if saved, err := n.LastSaveTime(); !saved.IsZero() || err != nil {
+		t.Fatalf("Expected no save time before saving, got %v and %v", saved, err)
+	}
+	before := time.Now()
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := n.LastSaveTime()
+	if saved.Before(before) || err != nil {
+		t.Fatalf("Expected the save time to be recorded, got %v and %v", saved, err)
+	}
+	path := n.filePath
+	n.filePath = filepath.Join(path, "missing", "state.json")
+	if n.Save() == nil {
+		t.Fatal("Expected the save to fail")
+	}
+	if failed, err := n.LastSaveTime(); !failed.Equal(saved) || err == nil {
+		t.Fatalf("Expected the last successful save time and the failure, got %v and %v", failed, err)
+	}
+	n.filePath = path
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if recovered, err := n.LastSaveTime(); recovered.Before(saved) || err != nil {
+		t.Fatalf("Expected the failure to be cleared by a successful save, got %v and %v", recovered, err)
+	}
+}
@@ -0,0 +1,106 @@
+package zigbee
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+)
+
+// streamsState will check if the network state is saved with the streaming encoder.
+func (n *Network) streamsState() bool {
+	return n.streamingSave && n.saveHook == nil && (n.codec == nil || n.codec == JSONCodec)
+}
+
+// streamSnapshot will write the JSON encoded form of the supplied network state snapshot to w, compressed if
+// configured. The content is the same produced by encodeSnapshot with the JSON codec.
+func (n *Network) streamSnapshot(w io.Writer, state *SerializedNetwork) error {
+	if n.gzipState {
+		zw := gzip.NewWriter(w)
+		if err := writeSnapshotJSON(zw, state); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+	return writeSnapshotJSON(w, state)
+}
+
+// writeSnapshotJSON will write the supplied network state snapshot to w as JSON, encoding one element at a time.
+// The fields are written in the order, and with the omissions, of the SerializedNetwork JSON tags.
+func writeSnapshotJSON(w io.Writer, state *SerializedNetwork) error {
+	bw := bufio.NewWriter(w)
+	sw := &snapshotWriter{w: bw}
+	sw.enc = json.NewEncoder(&sw.buf)
+	sw.raw(`{"devices":`)
+	if state.Devices == nil {
+		sw.raw("null")
+	} else {
+		sw.raw("[")
+		for i := range state.Devices {
+			sw.element(i, state.Devices[i])
+		}
+		sw.raw("]")
+	}
+	sw.raw(`,"groups":`)
+	if state.Groups == nil {
+		sw.raw("null")
+	} else {
+		sw.raw("[")
+		for i := range state.Groups {
+			sw.element(i, state.Groups[i])
+		}
+		sw.raw("]")
+	}
+	if len(state.Memberships) > 0 {
+		sw.raw(`,"memberships":[`)
+		for i := range state.Memberships {
+			sw.element(i, state.Memberships[i])
+		}
+		sw.raw("]")
+	}
+	if state.Coordinator != nil {
+		sw.raw(`,"coordinator":`)
+		sw.value(state.Coordinator)
+	}
+	sw.raw("}")
+	if sw.err != nil {
+		return sw.err
+	}
+	return bw.Flush()
+}
+
+// snapshotWriter writes JSON fragments to w, keeping the first error so that callers can check it once.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+	buf bytes.Buffer
+	err error
+}
+
+func (sw *snapshotWriter) raw(s string) {
+	if sw.err == nil {
+		_, sw.err = sw.w.WriteString(s)
+	}
+}
+
+// element will write the i-th element of an array, preceded by a comma when not the first.
+func (sw *snapshotWriter) element(i int, v interface{}) {
+	if i > 0 {
+		sw.raw(",")
+	}
+	sw.value(v)
+}
+
+// value will write the JSON encoding of v. The encoder buffer is reused across values, and the newline appended by
+// the encoder is dropped to match json.Marshal.
+func (sw *snapshotWriter) value(v interface{}) {
+	if sw.err != nil {
+		return
+	}
+	sw.buf.Reset()
+	if sw.err = sw.enc.Encode(v); sw.err != nil {
+		return
+	}
+	_, sw.err = sw.w.Write(bytes.TrimSuffix(sw.buf.Bytes(), []byte("\n")))
+}
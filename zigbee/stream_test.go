@@ -0,0 +1,59 @@
+package zigbee
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// savedContent returns the uncompressed content of the state file saved by a network populated by populate.
+func savedContent(t *testing.T, path string, populate func(*Network), options ...NetworkOption) []byte {
+	t.Helper()
+	n := NewNetworkState(true, options...)
+	n.filePath = path
+	populate(n)
+	if err := n.Save(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader, err := gzip.NewReader(bytes.NewReader(content)); err == nil {
+		if content, err = ioutil.ReadAll(reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return content
+}
+
+func TestStreamingSave(t *testing.T) {
+	dir := t.TempDir()
+	populations := map[string]func(*Network){
+		"empty":     func(*Network) {},
+		"populated": populateNetwork,
+		"complete": func(n *Network) {
+			populateNetwork(n)
+			n.SetCoordinator(Device{IEEEAddress: 0x00124B0000000001, NetworkAddress: NewZDOAddress(0)})
+			n.SetMetadata(1, "room", "kitchen <&>")
+			n.SetAttribute(2, LevelControlCluster, 0, 128)
+			seen := testDevice(3, 3)
+			seen.Label = "device"
+			seen.LastSeen = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			n.UpdateDevice(seen)
+			n.SetDeviceEnabled(3, false)
+		},
+	}
+	for name, populate := range populations {
+		for _, gzipped := range []bool{false, true} {
+			buffered := savedContent(t, filepath.Join(dir, "buffered"), populate, WithGzipState(gzipped))
+			streamed := savedContent(t, filepath.Join(dir, "streamed"), populate, WithGzipState(gzipped), WithStreamingSave())
+			if !bytes.Equal(buffered, streamed) {
+				t.Errorf("Expected %s state streamed with gzip %t to equal the buffered one, got\n%s\nand\n%s", name, gzipped, streamed, buffered)
+			}
+		}
+	}
+}
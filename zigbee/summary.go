@@ -0,0 +1,26 @@
+package zigbee
+
+import "encoding/json"
+
+// DeviceSummary is a compact representation of a device, suitable for constrained payloads.
+type DeviceSummary struct {
+	IEEEAddress  uint64
+	Label        string
+	Capabilities DeviceCapabilities
+}
+
+// Summary returns the compact representation of the device.
+func (d Device) Summary() DeviceSummary {
+	return DeviceSummary{IEEEAddress: d.IEEEAddress, Label: d.Label, Capabilities: d.Capabilities()}
+}
+
+// MarshalJSON will implement custom JSON serialization. The IEEE address is serialized as hex string and the
+// capabilities as an array of their names, for example {"ieeeAddress":"0x00124b0001abcdef","label":"Kitchen",
+// "capabilities":["light","dimmable"]}.
+func (s DeviceSummary) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		IEEEAddress  ieeeAddressJSON `json:"ieeeAddress"`
+		Label        string          `json:"label"`
+		Capabilities []string        `json:"capabilities"`
+	}{ieeeAddressJSON(s.IEEEAddress), s.Label, s.Capabilities.Names()})
+}
@@ -0,0 +1,27 @@
+package zigbee
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDeviceSummaryJSON(t *testing.T) {
+	device := testDevice(0x00124B0001ABCDEF, 1)
+	device.Label = "Kitchen"
+	device.InputClusterIds = []uint32{OnOffCluster, LevelControlCluster}
+	data, err := json.Marshal(device.Summary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"ieeeAddress":"0x00124b0001abcdef","label":"Kitchen","capabilities":["light","dimmable"]}`
+	if string(data) != expected {
+		t.Fatalf("Expected summary %s, got %s", expected, data)
+	}
+	data, err = json.Marshal(Device{IEEEAddress: 1}.Summary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"ieeeAddress":"0x0000000000000001","label":"","capabilities":[]}`; string(data) != expected {
+		t.Fatalf("Expected summary %s, got %s", expected, data)
+	}
+}
@@ -0,0 +1,222 @@
+package zigbee
+
+import "log"
+
+// BatchListener is the interface implemented by network or group listeners who prefer to be notified once of all
+// the changes applied by a transaction. Listeners not implementing it are notified of each change.
+type BatchListener interface {
+	NetworkBatchChanged(NetworkBatch)
+}
+
+// NetworkBatch summarizes the changes applied by a transaction.
+type NetworkBatch struct {
+	AddedDevices   []Device
+	UpdatedDevices []Device
+	RemovedDevices []Device
+	AddedGroups    []GroupAddress
+	UpdatedGroups  []GroupAddress
+	RemovedGroups  []GroupAddress
+}
+
+// IsEmpty will check if the batch contains no change.
+func (b NetworkBatch) IsEmpty() bool {
+	return len(b.AddedDevices) == 0 && len(b.UpdatedDevices) == 0 && len(b.RemovedDevices) == 0 &&
+		len(b.AddedGroups) == 0 && len(b.UpdatedGroups) == 0 && len(b.RemovedGroups) == 0
+}
+
+// NetworkTx applies changes to a network within a transaction.
+type NetworkTx struct {
+	network       *Network
+	batch         NetworkBatch
+	deviceChanges []func(NetworkListener)
+	groupChanges  []func(GroupListener)
+}
+
+// Transaction will apply the changes made by fn atomically. Listeners are notified once fn returns and the network
+// locks are released: batch listeners receive a single NetworkBatchChanged event, other listeners receive an event
+// for each change. fn runs holding the network write locks, so it must read and change the network through tx only:
+// calling the network methods acquiring a lock, like Groups, GroupMembers, Coordinator or any mutation, deadlocks.
+func (n *Network) Transaction(fn func(tx *NetworkTx)) {
+	if n.rejectFrozen("transaction") {
+		return
+	}
+	tx := &NetworkTx{network: n}
+	n.withWriteLocks(func() {
+		n.initDevices()
+		n.initGroups()
+		fn(tx)
+		if !tx.batch.IsEmpty() {
+			// Queued with the group notifications, so that the batch follows the membership changes of the transaction
+			n.queueGroupsDispatch(func() {
+				n.dispatchBatch(tx)
+			})
+		}
+	})
+}
+
+// dispatchBatch will synchronously notify listeners of the changes applied by the transaction.
+func (n *Network) dispatchBatch(tx *NetworkTx) {
+	n.listenersMx.RLock()
+	defer n.listenersMx.RUnlock()
+	var notified []interface{}
+	for i := range n.listeners {
+		registration := n.listeners[n.listenerIndex(i, len(n.listeners))]
+		if registration.replaying {
+			continue
+		}
+		if listener, ok := registration.listener.(BatchListener); ok {
+			listener.NetworkBatchChanged(tx.batch)
+			notified = append(notified, listener)
+			continue
+		}
+		for _, change := range tx.deviceChanges {
+			change(registration.listener)
+		}
+	}
+	for i := range n.groupListeners {
+		groupListener := n.groupListeners[n.listenerIndex(i, len(n.groupListeners))]
+		if listener, ok := groupListener.(BatchListener); ok {
+			if !containsListener(notified, listener) {
+				listener.NetworkBatchChanged(tx.batch)
+				notified = append(notified, listener)
+			}
+			continue
+		}
+		for _, change := range tx.groupChanges {
+			change(groupListener)
+		}
+	}
+}
+
+func containsListener(listeners []interface{}, listener interface{}) bool {
+	for _, l := range listeners {
+		if sameListener(l, listener) {
+			return true
+		}
+	}
+	return false
+}
+
+// Device returns the device with supplied address, including the changes made by the transaction.
+func (tx *NetworkTx) Device(address DeviceAddress) (Device, bool) {
+	n := tx.network
+	if n.deviceKeyFunc == nil {
+		device, ok := n.devices[address.String()]
+		return device, ok
+	}
+	for _, device := range n.devices {
+		if device.NetworkAddress == address {
+			return device, true
+		}
+	}
+	return Device{}, false
+}
+
+// Group returns the group with supplied id, including the changes made by the transaction.
+func (tx *NetworkTx) Group(groupID uint32) (GroupAddress, bool) {
+	group, ok := tx.network.groups[groupKey{groupID: groupID}]
+	return group, ok
+}
+
+// GroupMembers returns the sorted IEEE addresses of the members of the group with supplied id, including the changes
+// made by the transaction.
+func (tx *NetworkTx) GroupMembers(groupID uint32) []uint64 {
+	return sortedMembers(tx.network.memberships[groupKey{groupID: groupID}])
+}
+
+// AddDevice will add a new device to network, returning an error if the device can't be added.
+func (tx *NetworkTx) AddDevice(device Device) error {
+	n := tx.network
+	device, err := n.sanitizeDevice(n.normalizeDevice(device))
+	if err != nil {
+		return err
+	}
+	key := n.deviceKey(device)
+	if err := n.checkDeviceCapacity(key); err != nil {
+		return err
+	}
+	n.storeDevice(key, device)
+	n.logDevice(walAddDevice, device)
+	tx.batch.AddedDevices = append(tx.batch.AddedDevices, device)
+	tx.deviceChanges = append(tx.deviceChanges, func(listener NetworkListener) {
+		listener.DeviceAdded(device)
+	})
+	return nil
+}
+
+// UpdateDevice will update an existing device. Unchanged devices are not reported as updated.
+func (tx *NetworkTx) UpdateDevice(device Device) {
+	n := tx.network
+	device, err := n.sanitizeDevice(n.normalizeDevice(device))
+	if err != nil {
+		log.Printf("Unable to update device %s: %v", device.NetworkAddress, err)
+		return
+	}
+	key := n.deviceKey(device)
+	if n.redundantUpdate(key, device) {
+		return
+	}
+	n.storeDevice(key, device)
+	n.logDevice(walUpdateDevice, device)
+	tx.batch.UpdatedDevices = append(tx.batch.UpdatedDevices, device)
+	tx.deviceChanges = append(tx.deviceChanges, func(listener NetworkListener) {
+		listener.DeviceUpdated(device)
+	})
+}
+
+// RemoveDevice will remove the device from network, and its group memberships if no other device has its IEEE
+// address.
+func (tx *NetworkTx) RemoveDevice(device Device) {
+	if tx.network.deleteDevice(tx.network.deviceKey(device)) {
+		tx.network.logDevice(walRemoveDevice, device)
+	}
+	tx.network.removeMembershipsLocked(device.IEEEAddress)
+	tx.batch.RemovedDevices = append(tx.batch.RemovedDevices, device)
+	tx.deviceChanges = append(tx.deviceChanges, func(listener NetworkListener) {
+		listener.DeviceRemoved(device)
+	})
+}
+
+// AddGroup will add the group address to network.
+func (tx *NetworkTx) AddGroup(address GroupAddress) {
+	address, err := tx.network.sanitizeGroup(address)
+	if err != nil {
+		log.Printf("Unable to add group %s: %v", address, err)
+		return
+	}
+	tx.network.storeGroup(address)
+	tx.network.logGroup(walAddGroup, address)
+	tx.batch.AddedGroups = append(tx.batch.AddedGroups, address)
+	tx.groupChanges = append(tx.groupChanges, func(listener GroupListener) {
+		listener.GroupAdded(address)
+	})
+}
+
+// UpdateGroup will update the group address in network.
+func (tx *NetworkTx) UpdateGroup(address GroupAddress) {
+	address, err := tx.network.sanitizeGroup(address)
+	if err != nil {
+		log.Printf("Unable to update group %s: %v", address, err)
+		return
+	}
+	if previous, ok := tx.network.groups[address.key()]; ok {
+		tx.network.groupUpdated(previous, address)
+	}
+	tx.network.storeGroup(address)
+	tx.network.logGroup(walUpdateGroup, address)
+	tx.batch.UpdatedGroups = append(tx.batch.UpdatedGroups, address)
+	tx.groupChanges = append(tx.groupChanges, func(listener GroupListener) {
+		listener.GroupUpdated(address)
+	})
+}
+
+// RemoveGroup will remove the group address, and its memberships, from network.
+func (tx *NetworkTx) RemoveGroup(address GroupAddress) {
+	tx.network.deleteGroup(address.key())
+	tx.network.groupRemoved(address)
+	tx.network.logGroup(walRemoveGroup, address)
+	tx.batch.RemovedGroups = append(tx.batch.RemovedGroups, address)
+	tx.groupChanges = append(tx.groupChanges, func(listener GroupListener) {
+		listener.GroupRemoved(address)
+	})
+}
@@ -0,0 +1,76 @@
+package zigbee
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// batchListener records the batches of changes, and any single change notified instead.
+type batchListener struct {
+	recordingListener
+	batches []NetworkBatch
+	mx      sync.Mutex
+}
+
+func (l *batchListener) NetworkBatchChanged(batch NetworkBatch) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.batches = append(l.batches, batch)
+}
+
+func TestTransactionNotifiesSingleBatch(t *testing.T) {
+	n := NewNetworkState(true)
+	batches := &batchListener{}
+	n.AddNetworkListener(batches)
+	n.AddGroupListener(batches)
+	single := &recordingListener{}
+	n.AddNetworkListener(single)
+	n.Transaction(func(tx *NetworkTx) {
+		for i := uint32(1); i <= 10; i++ {
+			if err := tx.AddDevice(testDevice(uint64(i), i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := uint32(1); i <= 3; i++ {
+			tx.AddGroup(GroupAddress{GroupID: i, Label: "group"})
+		}
+	})
+	if len(batches.batches) != 1 || len(batches.Events()) != 0 {
+		t.Fatalf("Expected a single batch notification, got %d batches and events %v", len(batches.batches), batches.Events())
+	}
+	if batch := batches.batches[0]; len(batch.AddedDevices) != 10 || len(batch.AddedGroups) != 3 {
+		t.Fatalf("Expected 10 devices and 3 groups in the batch, got %v", batch)
+	}
+	if events := single.Events(); len(events) != 10 {
+		t.Fatalf("Expected an event for each device, got %v", events)
+	}
+
+	n.Transaction(func(tx *NetworkTx) {})
+	if len(batches.batches) != 1 {
+		t.Fatal("Expected no notification for an empty transaction")
+	}
+}
+
+func TestTransactionReads(t *testing.T) {
+	n := NewNetworkState(true)
+	n.AddGroup(GroupAddress{GroupID: 1, Label: "kitchen"})
+	n.AddGroupMember(1, 1)
+	waitDone(t, func() {
+		n.Transaction(func(tx *NetworkTx) {
+			if err := tx.AddDevice(testDevice(2, 2)); err != nil {
+				t.Error(err)
+			}
+			if _, ok := tx.Device(NewDeviceAddress(2, 1)); !ok {
+				t.Error("Expected device added by the transaction to be read")
+			}
+			tx.UpdateGroup(GroupAddress{GroupID: 1, Label: "garden"})
+			if group, _ := tx.Group(1); group.Label != "garden" {
+				t.Errorf("Expected group updated by the transaction to be read, got %v", group)
+			}
+			if members := tx.GroupMembers(1); !reflect.DeepEqual(members, []uint64{1}) {
+				t.Errorf("Expected group members to be read, got %v", members)
+			}
+		})
+	})
+}
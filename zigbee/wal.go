@@ -0,0 +1,151 @@
+package zigbee
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/pkg/errors"
+)
+
+// walOp identifies the mutation recorded by a write-ahead log record.
+type walOp string
+
+const (
+	walAddDevice      walOp = "addDevice"
+	walUpdateDevice   walOp = "updateDevice"
+	walRemoveDevice   walOp = "removeDevice"
+	walAddGroup       walOp = "addGroup"
+	walUpdateGroup    walOp = "updateGroup"
+	walRemoveGroup    walOp = "removeGroup"
+	walAddMember      walOp = "addMember"
+	walRemoveMember   walOp = "removeMember"
+	walSetCoordinator walOp = "setCoordinator"
+)
+
+// walRecord is a single mutation recorded in the write-ahead log, serialized as a JSON line.
+type walRecord struct {
+	Op     walOp           `json:"op"`
+	Device *Device         `json:"device,omitempty"`
+	Group  *GroupAddress   `json:"group,omitempty"`
+	Member ieeeAddressJSON `json:"member,omitempty"`
+}
+
+// logDevice will append the device mutation to the write-ahead log, if any.
+func (n *Network) logDevice(op walOp, device Device) {
+	n.logMutation(walRecord{Op: op, Device: &device})
+}
+
+// logGroup will append the group mutation to the write-ahead log, if any.
+func (n *Network) logGroup(op walOp, group GroupAddress) {
+	n.logMutation(walRecord{Op: op, Group: &group})
+}
+
+// logMember will append the group membership mutation to the write-ahead log, if any.
+func (n *Network) logMember(op walOp, group GroupAddress, ieee uint64) {
+	n.logMutation(walRecord{Op: op, Group: &group, Member: ieeeAddressJSON(ieee)})
+}
+
+// logMutation will append the record to the write-ahead log, if any. Write errors are logged and discarded, since
+// the mutation is already committed.
+func (n *Network) logMutation(record walRecord) {
+	if n.wal == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Unable to marshal write-ahead log record: %v", err)
+		return
+	}
+	n.walMx.Lock()
+	defer n.walMx.Unlock()
+	if _, err := n.wal.Write(append(line, '\n')); err != nil {
+		log.Printf("Unable to write write-ahead log record: %v", err)
+	}
+}
+
+// ReplayWAL will apply the mutations recorded in the write-ahead log read from r to the network, to reconstruct its
+// state after a crash. Listeners are not notified and the mutations are not recorded again.
+func (n *Network) ReplayWAL(r io.Reader) error {
+	var records []walRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return wrapError(CodeEncoding, err, fmt.Sprintf("Unable to unmarshal write-ahead log record at line %d", line))
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return wrapError(CodeIO, err, "Unable to read write-ahead log")
+	}
+	var err error
+	n.withWriteLocks(func() {
+		n.initDevices()
+		n.initGroups()
+		for i, record := range records {
+			if err = n.applyWALRecord(record); err != nil {
+				err = errors.Wrapf(err, "Unable to replay write-ahead log record %d", i+1)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// applyWALRecord will apply the mutation recorded by the supplied record. Caller must hold the devices and groups
+// write locks.
+func (n *Network) applyWALRecord(record walRecord) error {
+	switch record.Op {
+	case walAddDevice, walUpdateDevice, walRemoveDevice:
+		if record.Device == nil {
+			return newCodedError(CodeEncoding, fmt.Sprintf("Record %s has no device", record.Op))
+		}
+		if record.Op == walRemoveDevice {
+			n.deleteDevice(n.deviceKey(*record.Device))
+		} else {
+			n.storeDevice(n.deviceKey(*record.Device), *record.Device)
+		}
+	case walSetCoordinator:
+		if record.Device == nil {
+			return newCodedError(CodeEncoding, fmt.Sprintf("Record %s has no device", record.Op))
+		}
+		n.coordinator = record.Device
+		n.markDirty()
+	case walAddGroup, walUpdateGroup, walRemoveGroup, walAddMember, walRemoveMember:
+		if record.Group == nil {
+			return newCodedError(CodeEncoding, fmt.Sprintf("Record %s has no group", record.Op))
+		}
+		key := record.Group.key()
+		switch record.Op {
+		case walAddGroup, walUpdateGroup:
+			n.groups[key] = *record.Group
+		case walRemoveGroup:
+			delete(n.groups, key)
+			delete(n.memberships, key)
+		case walAddMember:
+			if n.memberships == nil {
+				n.memberships = make(map[groupKey]map[uint64]bool)
+			}
+			if n.memberships[key] == nil {
+				n.memberships[key] = make(map[uint64]bool)
+			}
+			n.memberships[key][uint64(record.Member)] = true
+		case walRemoveMember:
+			delete(n.memberships[key], uint64(record.Member))
+			if len(n.memberships[key]) == 0 {
+				delete(n.memberships, key)
+			}
+		}
+		n.markDirty()
+	default:
+		return newCodedError(CodeEncoding, fmt.Sprintf("Unknown write-ahead log operation %q", record.Op))
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package zigbee
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReplayWAL(t *testing.T) {
+	var wal bytes.Buffer
+	n := NewNetworkState(true, WithWriteAheadLog(&wal))
+	populateNetwork(n)
+	n.SetDeviceLabel(2, "lamp")
+	n.RemoveDeviceByIEEE(3)
+	n.UpdateGroup(GroupAddress{GroupID: 1, Label: "dining"})
+	n.RemoveGroupMember(1, 1)
+	n.AddGroup(GroupAddress{GroupID: 3, Label: "office"})
+	n.RemoveGroup(GroupAddress{GroupID: 2, Label: "garden"})
+	replayed := NewNetworkState(true)
+	if err := replayed.ReplayWAL(bytes.NewReader(wal.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !replayed.Equal(n) {
+		t.Fatalf("Expected the replayed network to equal the logged one, got %v and %v", replayed.DevicesSorted(), replayed.GroupsSorted())
+	}
+	if err := NewNetworkState(true).ReplayWAL(strings.NewReader("{corrupted\n")); err == nil {
+		t.Fatal("Expected a corrupted log to be rejected")
+	}
+}
+
+func TestWALSkipsMissingDeviceRemoval(t *testing.T) {
+	var wal bytes.Buffer
+	n := NewNetworkState(true, WithWriteAheadLog(&wal))
+	n.RemoveDevice(testDevice(1, 1))
+	n.Transaction(func(tx *NetworkTx) {
+		tx.RemoveDevice(testDevice(2, 2))
+	})
+	if wal.Len() != 0 {
+		t.Fatalf("Expected no record for missing devices, got %q", wal.String())
+	}
+}
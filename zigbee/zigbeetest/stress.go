@@ -0,0 +1,181 @@
+// Package zigbeetest provides helpers to test code built on the zigbee package.
+package zigbeetest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/maurofran/ziggo/zigbee"
+)
+
+// StressOptions configures a StressTest run. Zero values are replaced by defaults.
+type StressOptions struct {
+	// Readers is the number of goroutines querying the network, 4 by default.
+	Readers int
+	// Writers is the number of goroutines adding, updating and removing devices, 2 by default.
+	Writers int
+	// ListenerChurn is the number of goroutines adding and removing network listeners, 1 by default.
+	ListenerChurn int
+	// Devices is the number of devices mutated by writers, with network addresses from 1 to Devices, 64 by default.
+	Devices int
+	// Duration is how long the test runs, one second by default.
+	Duration time.Duration
+	// Listener returns the listener registered by listener churn goroutines. By default a no-op listener is used.
+	Listener func() zigbee.NetworkListener
+}
+
+// StressReport describes the result of a StressTest run.
+type StressReport struct {
+	Reads           uint64
+	Writes          uint64
+	ListenerChanges uint64
+	MaxReadLatency  time.Duration
+	MaxWriteLatency time.Duration
+	Elapsed         time.Duration
+	// Panics are the values of the panics recovered while running, including the ones raised by listeners notified
+	// synchronously.
+	Panics []string
+}
+
+// StressTest will exercise the network with concurrent readers, writers and listener churn for the configured
+// duration, collecting timings and panics. Each goroutine performs at least one operation, even if it's scheduled
+// after the duration expires. Writers mutate devices of the network, so a dedicated network should be used. Run it
+// with the race detector enabled to detect data races in listener implementations.
+func StressTest(n *zigbee.Network, opts StressOptions) StressReport {
+	opts = withDefaults(opts)
+	s := &stress{network: n, opts: opts, done: make(chan struct{})}
+	started := time.Now()
+	var wg sync.WaitGroup
+	run := func(count int, worker func(int)) {
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				worker(i)
+			}(i)
+		}
+	}
+	run(opts.Readers, s.read)
+	run(opts.Writers, s.write)
+	run(opts.ListenerChurn, s.churn)
+	time.Sleep(opts.Duration)
+	close(s.done)
+	wg.Wait()
+	s.report.Elapsed = time.Since(started)
+	return s.report
+}
+
+func withDefaults(opts StressOptions) StressOptions {
+	if opts.Readers <= 0 {
+		opts.Readers = 4
+	}
+	if opts.Writers <= 0 {
+		opts.Writers = 2
+	}
+	if opts.ListenerChurn <= 0 {
+		opts.ListenerChurn = 1
+	}
+	if opts.Devices <= 0 {
+		opts.Devices = 64
+	}
+	if opts.Duration <= 0 {
+		opts.Duration = time.Second
+	}
+	if opts.Listener == nil {
+		opts.Listener = func() zigbee.NetworkListener { return &noopListener{} }
+	}
+	return opts
+}
+
+// stress is the state of a StressTest run.
+type stress struct {
+	network *zigbee.Network
+	opts    StressOptions
+	done    chan struct{}
+	mx      sync.Mutex
+	report  StressReport
+}
+
+// running will check if the run is still in progress.
+func (s *stress) running() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// measure will run op, recovering panics and returning its duration.
+func (s *stress) measure(op func()) time.Duration {
+	started := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			s.mx.Lock()
+			s.report.Panics = append(s.report.Panics, fmt.Sprint(r))
+			s.mx.Unlock()
+		}
+	}()
+	op()
+	return time.Since(started)
+}
+
+func (s *stress) read(worker int) {
+	for i := 0; i == 0 || s.running(); i++ {
+		address := zigbee.NewDeviceAddress(uint32(i%s.opts.Devices+1), 1)
+		latency := s.measure(func() {
+			s.network.Device(address)
+			s.network.Devices()
+			s.network.Groups()
+		})
+		s.mx.Lock()
+		s.report.Reads++
+		if latency > s.report.MaxReadLatency {
+			s.report.MaxReadLatency = latency
+		}
+		s.mx.Unlock()
+	}
+}
+
+func (s *stress) write(worker int) {
+	for i := 0; i == 0 || s.running(); i++ {
+		address := zigbee.NewDeviceAddress(uint32((i+worker)%s.opts.Devices+1), 1)
+		device := zigbee.Device{IEEEAddress: uint64(address.NetworkAddress), NetworkAddress: address}
+		latency := s.measure(func() {
+			switch i % 3 {
+			case 0:
+				s.network.AddDevice(device)
+			case 1:
+				device.Label = fmt.Sprintf("stress-%d", i)
+				s.network.UpdateDevice(device)
+			default:
+				s.network.RemoveDevice(device)
+			}
+		})
+		s.mx.Lock()
+		s.report.Writes++
+		if latency > s.report.MaxWriteLatency {
+			s.report.MaxWriteLatency = latency
+		}
+		s.mx.Unlock()
+	}
+}
+
+func (s *stress) churn(worker int) {
+	for i := 0; i == 0 || s.running(); i++ {
+		s.measure(func() {
+			handle := s.network.AddNetworkListener(s.opts.Listener())
+			s.network.RemoveNetworkListenerHandle(handle)
+		})
+		s.mx.Lock()
+		s.report.ListenerChanges += 2
+		s.mx.Unlock()
+	}
+}
+
+type noopListener struct{}
+
+func (l *noopListener) DeviceAdded(zigbee.Device)   {}
+func (l *noopListener) DeviceUpdated(zigbee.Device) {}
+func (l *noopListener) DeviceRemoved(zigbee.Device) {}
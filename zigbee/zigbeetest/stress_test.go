@@ -0,0 +1,68 @@
+package zigbeetest
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maurofran/ziggo/zigbee"
+)
+
+// countingListener counts the notifications it receives.
+type countingListener struct {
+	events *uint64
+}
+
+func (l *countingListener) DeviceAdded(zigbee.Device)   { atomic.AddUint64(l.events, 1) }
+func (l *countingListener) DeviceUpdated(zigbee.Device) { atomic.AddUint64(l.events, 1) }
+func (l *countingListener) DeviceRemoved(zigbee.Device) { atomic.AddUint64(l.events, 1) }
+
+func TestStressTest(t *testing.T) {
+	n := zigbee.NewNetworkState(true)
+	var events uint64
+	n.AddNetworkListener(&countingListener{events: &events})
+	report := StressTest(n, StressOptions{
+		Readers:       4,
+		Writers:       4,
+		ListenerChurn: 2,
+		Devices:       16,
+		Duration:      200 * time.Millisecond,
+		Listener: func() zigbee.NetworkListener {
+			return &countingListener{events: &events}
+		},
+	})
+	if report.Reads == 0 || report.Writes == 0 || report.ListenerChanges == 0 {
+		t.Fatalf("Expected reads, writes and listener changes, got %+v", report)
+	}
+	if len(report.Panics) != 0 {
+		t.Fatalf("Expected no panics, got %v", report.Panics)
+	}
+	if atomic.LoadUint64(&events) == 0 {
+		t.Fatal("Expected listeners to be notified of the writes")
+	}
+	if report.Elapsed < 200*time.Millisecond || report.MaxWriteLatency <= 0 {
+		t.Fatalf("Expected timings to be collected, got %+v", report)
+	}
+}
+
+// panickingListener panics on every device notification.
+type panickingListener struct{}
+
+func (l *panickingListener) DeviceAdded(zigbee.Device)   { panic("device added") }
+func (l *panickingListener) DeviceUpdated(zigbee.Device) { panic("device updated") }
+func (l *panickingListener) DeviceRemoved(zigbee.Device) { panic("device removed") }
+
+func TestStressTestCollectsPanics(t *testing.T) {
+	n := zigbee.NewNetworkState(true)
+	handle := n.AddNetworkListener(&panickingListener{})
+	report := StressTest(n, StressOptions{Writers: 1, Duration: 50 * time.Millisecond})
+	if len(report.Panics) == 0 {
+		t.Fatalf("Expected listener panics to be collected, got %+v", report)
+	}
+	n.RemoveNetworkListenerHandle(handle)
+	address := zigbee.NewDeviceAddress(100, 1)
+	n.AddDevice(zigbee.Device{IEEEAddress: 100, NetworkAddress: address})
+	if _, ok := n.Device(address); !ok {
+		t.Fatal("Expected the network to stay usable after listener panics")
+	}
+}